@@ -0,0 +1,279 @@
+// +build !appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+// smoke-hub runs the hub as a standalone net/http server,
+// for hosting outside of appengine and local development.
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "net"
+    "flag"
+    "strings"
+    "database/sql"
+    "encoding/json"
+    "log"
+    "time"
+    "net/http"
+    "dhcp"
+    "repository"
+    "transport"
+    "encryption"
+    "server"
+    _ "github.com/lib/pq"
+    _ "github.com/mattn/go-sqlite3"
+)
+
+var listen  = flag.String("listen", ":8080", "address to listen on.")
+var admin   = flag.String("admin",  "",      "address to serve the admin api on, empty to disable.")
+var www     = flag.String("www",    "www",   "directory of static content, empty to disable.")
+var backend = flag.String("repository", "memory", "repository backend, memory, bolt:<path>, sqlite:<path> or postgres:<dsn>.")
+var layout  = flag.String("format",  "dotted", "address format, dotted, base32, hex or words.")
+var ordered = flag.Bool  ("sequential", false, "hand out addresses in order, rather than permuted.")
+var checked = flag.Bool  ("checksum",   false, "append a check segment to addresses, so mistyped addresses are rejected.")
+var lease   = flag.Int64 ("block",   0,       "ordinals leased from the repository at a time, 0 to allocate one at a time.")
+var reserve = flag.Int64 ("reserved", dhcp.DefaultReserved, "addresses at the top of the address space reserved for claims.")
+var timeout = flag.Duration("lease-timeout", dhcp.DefaultLeasePolicy.Timeout,    "time after which a address not renewed expires.")
+var holdoff = flag.Duration("quarantine",    dhcp.DefaultLeasePolicy.Quarantine, "time a expired or released address is held before reuse.")
+var legacy  = flag.String("legacy-tokens", encryption.DefaultLegacyCutoff.Format("2006-01-02"), "date legacy AES-CFB identity tokens are accepted until, as 2006-01-02 or rfc 3339, empty to reject them.")
+var rotate  = flag.Duration("rotate", 0, "interval at which the identity key is rotated, 0 to rotate only from the admin api.")
+var retire  = flag.Duration("retire", encryption.DefaultKeyRetire, "time identity keys decrypt identities after being rotated out.")
+var tokens  = flag.String("tokens", "aead", "identity tokens, aead to seal them, or hs256 or eddsa to sign them.")
+var binding = flag.String("binding", "ip", "identity binding, ip, prefix, forwarded, secret or none.")
+var proxies = flag.String("proxies", "",  "comma separated cidrs of proxies trusted to set X-Forwarded-For, for forwarded binding.")
+var restore = flag.String("import",  "",      "imports a appengine /admin/export file into the repository and exits.")
+
+// opens the repository named by the repository flag.
+func open() (repository.Repository, error) {
+    kind, path := *backend, ""
+    if index := strings.Index(kind, ":"); index != -1 {
+        kind, path = kind[:index], kind[index + 1:]
+    }
+    switch kind {
+        case "memory":
+            return repository.NewMemoryRepository(), nil
+        case "bolt":
+            return repository.NewBoltRepository(path)
+        case "sqlite":
+            return sqlRepository("sqlite3", path)
+        case "postgres":
+            return sqlRepository("postgres", path)
+        default:
+            return nil, fmt.Errorf("unknown repository %q.", *backend)
+    }
+}
+
+// opens a sql repository with the given driver and source.
+func sqlRepository(driver string, source string) (repository.Repository, error) {
+    if db, err := sql.Open(driver, source); err != nil {
+        return nil, err
+    } else {
+        if store, err := repository.NewSqlRepository(db); err != nil {
+            db.Close()
+            return nil, err
+        } else {
+            return store, nil
+        }
+    }
+}
+
+// returns the identity binding named by the binding flag.
+func bind() (server.Binding, error) {
+    switch *binding {
+        case "ip":
+            return server.IPBinding {}, nil
+        case "prefix":
+            return server.DefaultPrefixBinding, nil
+        case "forwarded":
+            var forwarded server.ForwardedBinding
+            for _, cidr := range strings.Split(*proxies, ",") {
+                if cidr = strings.TrimSpace(cidr); cidr == "" {
+                    continue
+                }
+                if _, network, err := net.ParseCIDR(cidr); err != nil {
+                    return nil, err
+                } else {
+                    forwarded.Proxies = append(forwarded.Proxies, network)
+                }
+            }
+            return forwarded, nil
+        case "secret":
+            return server.SecretBinding {}, nil
+        case "none":
+            return server.NoBinding {}, nil
+        default:
+            return nil, fmt.Errorf("unknown binding %q.", *binding)
+    }
+}
+
+// returns the time legacy identity tokens are accepted until, 
+// parsed from the legacy tokens flag. Dates are taken as midnight 
+// utc, and an empty flag rejects legacy tokens.
+func cutoff() (time.Time, error) {
+    if *legacy == "" {
+        return time.Time {}, nil
+    } else if until, err := time.Parse("2006-01-02", *legacy); err == nil {
+        return until, nil
+    } else if until, err := time.Parse(time.RFC3339, *legacy); err == nil {
+        return until, nil
+    } else {
+        return time.Time {}, fmt.Errorf("invalid legacy tokens cutoff %q.", *legacy)
+    }
+}
+
+// returns the identity token provider named by the tokens flag.
+func provide(store repository.Repository, keys *encryption.KeyRing, until time.Time) (encryption.EncryptionProvider, error) {
+    switch *tokens {
+        case "aead":
+            return encryption.NewAeadEncryptionProvider(store, keys, encryption.NewAesEncryptionProvider(store), until), nil
+        case "hs256":
+            return encryption.NewSignedTokenProvider(store, keys, encryption.HS256)
+        case "eddsa":
+            return encryption.NewSignedTokenProvider(store, keys, encryption.EdDSA)
+        default:
+            return nil, fmt.Errorf("unknown tokens %q.", *tokens)
+    }
+}
+
+// imports the given export file into the given repository.
+func load(store repository.Repository, path string) error {
+    importer, ok := store.(interface { Import(repository.Export) error })
+    if !ok {
+        return fmt.Errorf("repository %q does not support import.", *backend)
+    }
+    if file, err := os.Open(path); err != nil {
+        return err
+    } else {
+        defer file.Close()
+        var export repository.Export
+        if err := json.NewDecoder(file).Decode(&export); err != nil {
+            return err
+        }
+        return importer.Import(export)
+    }
+}
+
+func main() {
+    flag.Parse()
+    store, err := open()
+    if err != nil {
+        log.Fatal(err)
+    }
+    if closer, ok := store.(io.Closer); ok {
+        defer closer.Close()
+    }
+    if *restore != "" {
+        if err := load(store, *restore); err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("imported %s", *restore)
+        return
+    }
+    policy, err := bind()
+    if err != nil {
+        log.Fatal(err)
+    }
+    formatter, ok := dhcp.Formatters[*layout]
+    if !ok {
+        log.Fatalf("unknown address format %q.", *layout)
+    }
+    if *checked {
+        formatter = dhcp.ChecksumFormatter { Formatter: formatter }
+    }
+    if *reserve < 0 || *reserve >= dhcp.Capacity {
+        log.Fatalf("reserved addresses must be between 0 and %d.", dhcp.Capacity - 1)
+    }
+    var space = dhcp.AddressSpace { Permutation: dhcp.NewFeistelPermutation(store), Formatter: formatter, Reserved: *reserve }
+    if *ordered {
+        space.Permutation = dhcp.IdentityPermutation {}
+    }
+    var allocator dhcp.AddressAllocator = dhcp.NewVirtualAddressAllocator(store, space)
+    if *lease > 0 {
+        allocator = dhcp.NewBlockAddressAllocator(store, space, dhcp.NewOrdinalBlock(*lease))
+    }
+    allocator = dhcp.NewLeaseAddressAllocator(store, space, allocator, dhcp.LeasePolicy { Timeout: *timeout, Quarantine: *holdoff })
+    var claims    = dhcp.NewClaimRegistry(store, space)
+    var keys      = encryption.NewKeyRing(encryption.DefaultKeyRefresh, *retire)
+    until, err := cutoff()
+    if err != nil {
+        log.Fatal(err)
+    }
+    provider, err := provide(store, keys, until)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if rotator, ok := provider.(encryption.Rotator); ok && *rotate > 0 {
+        go func() {
+            for range time.Tick(*rotate) {
+                if key, err := rotator.Rotate(); err != nil {
+                    log.Printf("unable to rotate identity key: %v", err)
+                } else {
+                    log.Printf("rotated identity key to %d", key)
+                }
+            }
+        }()
+    }
+    var replays     = server.NewReplayCache(store)
+    var revocations = server.NewRevocationList(store)
+    var websocket   = transport.NewWebSocketTransport()
+    var events      = transport.NewEventSourceTransport(transport.NewMailbox(256, 10 * time.Minute))
+    var poll        = transport.NewPollTransport      (transport.NewMailbox(256, 10 * time.Minute))
+    var selector    = transport.NewSelector(websocket, events, poll)
+    var hub         = server.NewServer(func(r *http.Request) server.Services {
+        return server.Services {
+            Formatter   : formatter,
+            Allocator   : allocator,
+            Claims      : claims,
+            Encryption  : provider,
+            Transport   : selector,
+            Binding     : policy,
+            Replay      : replays,
+            Revocations : revocations,
+            LegacyUntil : until,
+        }
+    })
+    mux := http.NewServeMux()
+    hub.Register(mux)
+    mux.Handle("/socket", websocket)
+    mux.Handle("/events", server.Cors(events))
+    if *www != "" {
+        mux.Handle("/", http.FileServer(http.Dir(*www)))
+    }
+    if *admin != "" {
+        operators := http.NewServeMux()
+        hub.RegisterAdmin(operators)
+        log.Printf("smoke-hub admin listening on %s", *admin)
+        go func() { log.Fatal(http.ListenAndServe(*admin, operators)) }()
+    }
+    log.Printf("smoke-hub listening on %s", *listen)
+    log.Fatal(http.ListenAndServe(*listen, mux))
+}
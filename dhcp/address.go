@@ -0,0 +1,167 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "bytes"
+import "strings"
+import "strconv"
+
+// the longest address string accepted by Parse.
+const MaxAddressLength = 64
+
+// a address in the address space, as the spatial indices of
+// its value computed by conical.
+type Address [6]int64
+
+// returns the address for the given address value.
+func AddressOf(value int64) Address {
+  return conical(value)
+}
+
+// returns the address value of this address.
+func (address Address) Value() int64 {
+  return inverse(address)
+}
+
+// returns true if this address is in the address space.
+func (address Address) Valid() bool {
+  for i := 0; i < len(address); i++ {
+    if address[i] < 0 || address[i] > 255 {
+      return false
+    }
+  }
+  return true
+}
+
+// returns true if this address equals the given address.
+func (address Address) Equal(other Address) bool {
+  return address == other
+}
+
+// returns the address in the dotted form.
+func (address Address) String() string {
+  var buffer bytes.Buffer
+  for i := 0; i < len(address); i++ {
+    buffer.WriteString(strconv.FormatInt(address[i], 10))
+    if(i != len(address) - 1) {
+      buffer.WriteString(".")
+    }
+  }
+  return buffer.String()
+}
+
+// parses the given address string in any of the address 
+// formats, with or without a check segment. returns 
+// ErrInvalidAddress if the string is empty, longer than 
+// MaxAddressLength, or not a address, and ErrChecksumMismatch
+// if the check segment does not match the address.
+func Parse(input string) (Address, error) {
+  if len(input) == 0 || len(input) > MaxAddressLength {
+    return Address {}, ErrInvalidAddress
+  }
+  if head, check, ok := splitChecksum(input); ok {
+    if address, err := parse(head); err != nil {
+      return Address {}, err
+    } else {
+      return verifyChecksum(address, check)
+    }
+  }
+  return parse(input)
+}
+
+// returns the dotted form of the given address string, parsed as
+// Parse. Records are keyed by address in this form, so survive a 
+// change of format.
+func Canonical(input string) (string, error) {
+  if address, err := Parse(input); err != nil {
+    return "", err
+  } else {
+    return address.String(), nil
+  }
+}
+
+// parses the given address string in any of the address formats.
+func parse(input string) (Address, error) {
+  for _, formatter := range Formatters {
+    if address, err := formatter.Parse(input); err == nil {
+      return address, nil
+    }
+  }
+  return Address {}, ErrInvalidAddress
+}
+
+// separates a address from its sub-address.
+const SubAddressSeparator = "/"
+
+// the largest sub-address.
+const MaxSubAddress int64 = 1 << 32 - 1
+
+// the sub-address of a address given without one.
+const NoSubAddress int64 = -1
+
+// a address with a optional sub-address, such as 1.2.3.4.5.6/7. The
+// connection leased a address owns every sub-address under it, and
+// messages to a sub-address are routed by its address.
+type SubAddress struct {
+  Address Address
+  Sub     int64
+}
+
+// formats this sub-address with the given formatter.
+func (address SubAddress) Format(formatter AddressFormatter) string {
+  if address.Sub == NoSubAddress {
+    return formatter.Format(address.Address)
+  }
+  return formatter.Format(address.Address) + SubAddressSeparator + strconv.FormatInt(address.Sub, 10)
+}
+
+// parses the given address string, with or without a sub-address.
+// the address is parsed as Parse, and the sub-address is a decimal
+// between 0 and MaxSubAddress.
+func ParseSubAddress(input string) (SubAddress, error) {
+  index := strings.Index(input, SubAddressSeparator)
+  if index < 0 {
+    if address, err := Parse(input); err != nil {
+      return SubAddress {}, err
+    } else {
+      return SubAddress { Address: address, Sub: NoSubAddress }, nil
+    }
+  }
+  component := input[index + 1:]
+  if len(component) == 0 || len(component) > 10 || strings.TrimLeft(component, "0123456789") != "" {
+    return SubAddress {}, ErrInvalidAddress
+  }
+  if sub, err := strconv.ParseInt(component, 10, 64); err != nil || sub > MaxSubAddress {
+    return SubAddress {}, ErrInvalidAddress
+  } else if address, err := Parse(input[:index]); err != nil {
+    return SubAddress {}, err
+  } else {
+    return SubAddress { Address: address, Sub: sub }, nil
+  }
+}
@@ -0,0 +1,157 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+
+package dhcp
+
+import "strings"
+import "testing"
+
+func TestAddressString(t *testing.T) {
+  tests := []struct {
+    value    int64
+    expected string
+  } {
+    { 0,                     "0.0.0.0.0.0" },
+    { 1,                     "1.0.0.0.0.0" },
+    { 255,                   "255.0.0.0.0.0" },
+    { 256,                   "0.1.0.0.0.0" },
+    { 6 << 40 | 5 << 32 | 4 << 24 | 3 << 16 | 2 << 8 | 1, "1.2.3.4.5.6" },
+    { Capacity - 1,          "255.255.255.255.255.255" },
+  }
+  for _, test := range tests {
+    address := AddressOf(test.value)
+    if output := address.String(); output != test.expected {
+      t.Errorf("expected %d as %s, got %s", test.value, test.expected, output)
+    }
+    if !address.Valid() || address.Value() != test.value {
+      t.Errorf("expected %s valid with value %d, got %v %d", test.expected, test.value, address.Valid(), address.Value())
+    }
+    if parsed, err := Parse(test.expected); err != nil || !parsed.Equal(address) {
+      t.Errorf("expected %s parsed to %v, got %v %v", test.expected, address, parsed, err)
+    }
+  }
+  for _, address := range []Address { { -1, 0, 0, 0, 0, 0 }, { 0, 0, 0, 0, 0, 256 } } {
+    if address.Valid() {
+      t.Errorf("expected %v invalid", address)
+    }
+  }
+}
+
+func TestAddressParse(t *testing.T) {
+  tests := []struct {
+    input    string
+    expected string
+    err      error
+  } {
+    { "1.2.3.4.5.6",                              "1.2.3.4.5.6", nil },
+    { "001.002.003.004.005.006",                  "1.2.3.4.5.6", nil },
+    { "aaaaaaaaau",                               "5.0.0.0.0.0", nil },
+    { "000000000005",                             "5.0.0.0.0.0", nil },
+    { "alarm-acorn-acorn-acorn-acorn-acorn",      "5.0.0.0.0.0", nil },
+    { "1.2.3.4.5.6-d3",                           "1.2.3.4.5.6", nil },
+    { "1.2.3.4.5.6-D3",                           "1.2.3.4.5.6", nil },
+    { "1.2.3.4.5.6-d4",                           "",            ErrChecksumMismatch },
+    { "",                                         "",            ErrInvalidAddress },
+    { " 1.2.3.4.5.6",                             "",            ErrInvalidAddress },
+    { "1.2.3.4.5.6 ",                             "",            ErrInvalidAddress },
+    { "1.2.3.4.5.6/7",                            "",            ErrInvalidAddress },
+    { "1.2.3.4.5.6-",                             "",            ErrInvalidAddress },
+    { "1.2.3.4.5.6-zz",                           "",            ErrInvalidAddress },
+    { "nonsense",                                 "",            ErrInvalidAddress },
+    { strings.Repeat("0", MaxAddressLength + 1),  "",            ErrInvalidAddress },
+  }
+  for _, test := range tests {
+    parsed, err := Parse(test.input)
+    if err != test.err {
+      t.Errorf("%q: expected %v, got %v %v", test.input, test.err, parsed, err)
+    } else if err == nil && parsed.String() != test.expected {
+      t.Errorf("%q: expected %s, got %s", test.input, test.expected, parsed.String())
+    }
+    if canonical, err := Canonical(test.input); err != test.err || canonical != test.expected {
+      t.Errorf("%q: expected canonical %q %v, got %q %v", test.input, test.expected, test.err, canonical, err)
+    }
+  }
+}
+
+func TestParseSubAddress(t *testing.T) {
+  tests := []struct {
+    input    string
+    expected string
+    sub      int64
+    err      error
+  } {
+    { "1.2.3.4.5.6",                  "1.2.3.4.5.6", NoSubAddress,  nil },
+    { "1.2.3.4.5.6/0",                "1.2.3.4.5.6", 0,             nil },
+    { "1.2.3.4.5.6/7",                "1.2.3.4.5.6", 7,             nil },
+    { "1.2.3.4.5.6/0000000007",       "1.2.3.4.5.6", 7,             nil },
+    { "1.2.3.4.5.6/4294967295",       "1.2.3.4.5.6", MaxSubAddress, nil },
+    { "1.2.3.4.5.6-d3/7",             "1.2.3.4.5.6", 7,             nil },
+    { "aaaaaaaaau/7",                 "5.0.0.0.0.0", 7,             nil },
+    { "alarm-acorn-acorn-acorn-acorn-acorn/7", "5.0.0.0.0.0", 7,    nil },
+    { "1.2.3.4.5.6/4294967296",       "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/99999999999",      "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/00000000007",      "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/",                 "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/-1",               "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/+1",               "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/1 ",               "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/0x1",              "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6/1/2",              "", 0, ErrInvalidAddress },
+    { "/7",                           "", 0, ErrInvalidAddress },
+    { "1.2.3.4.5.6-d4/7",             "", 0, ErrChecksumMismatch },
+  }
+  for _, test := range tests {
+    address, err := ParseSubAddress(test.input)
+    if err != test.err {
+      t.Errorf("%q: expected %v, got %v %v", test.input, test.err, address, err)
+    } else if err == nil && (address.Address.String() != test.expected || address.Sub != test.sub) {
+      t.Errorf("%q: expected %s sub %d, got %s sub %d", test.input, test.expected, test.sub, address.Address.String(), address.Sub)
+    }
+  }
+}
+
+func TestSubAddressFormat(t *testing.T) {
+  address := AddressOf(5)
+  tests := []struct {
+    sub      int64
+    expected string
+  } {
+    { NoSubAddress,  "000000000005" },
+    { 0,             "000000000005/0" },
+    { MaxSubAddress, "000000000005/4294967295" },
+  }
+  for _, test := range tests {
+    output := SubAddress { Address: address, Sub: test.sub }.Format(HexFormatter {})
+    if output != test.expected {
+      t.Errorf("expected %s, got %s", test.expected, output)
+    } else if parsed, err := ParseSubAddress(output); err != nil || parsed.Address != address || parsed.Sub != test.sub {
+      t.Errorf("expected %s parsed back, got %v %v", output, parsed, err)
+    }
+  }
+}
@@ -0,0 +1,102 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "errors"
+import "strings"
+import "encoding/hex"
+
+// returned when parsing a address whose check segment does not
+// match, as the address was mistyped.
+var ErrChecksumMismatch = errors.New("address checksum mismatch.")
+
+// separates a address from its check segment.
+const checkSeparator = "-"
+
+// returns the crc-8 (polynomial 0x07) of the address value. A
+// crc-8 detects any change confined to one octet of the value, 
+// such as a single mistyped digit, word or character.
+func Checksum(address Address) byte {
+  var crc byte = 0
+  for _, octet := range bytes6(address.Value()) {
+    crc ^= octet
+    for i := 0; i < 8; i++ {
+      if crc & 0x80 != 0 {
+        crc = crc << 1 ^ 0x07
+      } else {
+        crc = crc << 1
+      }
+    }
+  }
+  return crc
+}
+
+// splits the check segment from the given address string. returns
+// false if the string has no check segment.
+func splitChecksum(input string) (string, byte, bool) {
+  index := strings.LastIndex(input, checkSeparator)
+  if index < 0 || len(input) - index != 3 {
+    return "", 0, false
+  }
+  if check, err := hex.DecodeString(strings.ToLower(input[index + 1:])); err != nil {
+    return "", 0, false
+  } else {
+    return input[:index], check[0], true
+  }
+}
+
+// verifies the check segment of the given address.
+func verifyChecksum(address Address, check byte) (Address, error) {
+  if Checksum(address) != check {
+    return Address {}, ErrChecksumMismatch
+  }
+  return address, nil
+}
+
+//-----------------------------------------------------
+// checksum: 1.2.3.4.5.6-d3
+//-----------------------------------------------------
+
+// appends a 2 digit hex check segment to the addresses of the 
+// given formatter, so mistyped addresses are caught on parse.
+type ChecksumFormatter struct {
+  Formatter AddressFormatter
+}
+func (formatter ChecksumFormatter) Format(address Address) string {
+  return formatter.Formatter.Format(address) + checkSeparator + hex.EncodeToString([]byte { Checksum(address) })
+}
+func (formatter ChecksumFormatter) Parse(input string) (Address, error) {
+  if head, check, ok := splitChecksum(input); !ok {
+    return Address {}, ErrInvalidAddress
+  } else if address, err := formatter.Formatter.Parse(head); err != nil {
+    return Address {}, ErrInvalidAddress
+  } else {
+    return verifyChecksum(address, check)
+  }
+}
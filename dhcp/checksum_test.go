@@ -0,0 +1,105 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+
+package dhcp
+
+import "strings"
+import "testing"
+
+// the characters each format is typed in.
+var formatAlphabets = map[string]string {
+  "dotted" : "0123456789",
+  "base32" : "abcdefghijklmnopqrstuvwxyz234567",
+  "hex"    : "0123456789abcdef",
+  "words"  : "abcdefghijklmnopqrstuvwxyz",
+}
+
+// returns true if the given typo of the given address is rejected,
+// or parses to the address itself.
+func typoRejected(address Address, typo string) bool {
+  parsed, err := Parse(typo)
+  return err != nil || parsed == address
+}
+
+func TestChecksumVector(t *testing.T) {
+  // the example of the readme.
+  if output := (ChecksumFormatter { DottedFormatter {} }).Format(AddressOf(6 << 40 | 5 << 32 | 4 << 24 | 3 << 16 | 2 << 8 | 1)); output != "1.2.3.4.5.6-d3" {
+    t.Fatalf("expected 1.2.3.4.5.6-d3, got %s", output)
+  }
+}
+
+func TestChecksumTypos(t *testing.T) {
+  for name, formatter := range Formatters {
+    checked := ChecksumFormatter { formatter }
+    for _, value := range testValues()[:24] {
+      address := AddressOf(value)
+      input   := checked.Format(address)
+      // every single mistyped character, in the address or its check
+      // segment, is rejected.
+      for i := 0; i < len(input); i++ {
+        for _, c := range formatAlphabets[name] + "0123456789abcdef" {
+          if typo := input[:i] + string(c) + input[i + 1:]; !typoRejected(address, typo) {
+            t.Fatalf("%s: expected typo %s of %s rejected", name, typo, input)
+          }
+        }
+      }
+    }
+  }
+  // every single mistyped word is rejected.
+  for _, value := range testValues()[:8] {
+    address    := AddressOf(value)
+    components := strings.Split(ChecksumFormatter { WordFormatter {} }.Format(address), "-")
+    for i := 0; i < len(address); i++ {
+      for _, word := range words {
+        typo := append([]string(nil), components...)
+        typo[i] = word
+        if input := strings.Join(typo, "-"); !typoRejected(address, input) {
+          t.Fatalf("expected mistyped word %s rejected", input)
+        }
+      }
+    }
+  }
+}
+
+func TestChecksumMismatch(t *testing.T) {
+  address := AddressOf(6 << 40 | 5 << 32 | 4 << 24 | 3 << 16 | 2 << 8 | 1)
+  for name, formatter := range Formatters {
+    checked := ChecksumFormatter { formatter }
+    if _, err := checked.Parse(formatter.Format(address)); err != ErrInvalidAddress {
+      t.Errorf("%s: expected address without check segment rejected, got %v", name, err)
+    }
+    if _, err := checked.Parse(formatter.Format(address) + "-00"); err != ErrChecksumMismatch {
+      t.Errorf("%s: expected wrong check segment rejected, got %v", name, err)
+    }
+    // addresses without a check segment are still accepted by Parse.
+    if parsed, err := Parse(formatter.Format(address)); err != nil || parsed != address {
+      t.Errorf("%s: expected %v, got %v %v", name, address, parsed, err)
+    }
+  }
+}
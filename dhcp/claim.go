@@ -0,0 +1,106 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "time"
+import "errors"
+import "repository"
+import "crypto/subtle"
+import "crypto/sha256"
+import "encoding/base64"
+
+// returned when claiming a address without its claim secret.
+var ErrClaimRejected = errors.New("address claim rejected.")
+
+// returned when registering a claim on a address that is not in
+// the reserved range.
+var ErrNotReserved = errors.New("address not reserved.")
+
+// registry of claims on reserved addresses. A claim is registered
+// by a operator, and grants the holder of its secret the address
+// on connect. Claims are held in the repository keyed by the
+// dotted form of the address, so survive a change of format.
+type ClaimRegistry struct {
+  repository repository.Repository
+  space      AddressSpace
+}
+
+// returns the base64 sha256 hash of the given secret.
+func claimHash(secret string) string {
+  sum := sha256.Sum256([]byte(secret))
+  return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+// registers a claim on the given address, replacing any existing
+// claim. returns the address string and a new random secret.
+func (registry ClaimRegistry) Register(input string) (string, string, error) {
+  if address, err := Parse(input); err != nil {
+    return "", "", err
+  } else if !registry.space.Reserves(address) {
+    return "", "", ErrNotReserved
+  } else if bytes, err := repository.GenerateRandomBytes(24); err != nil {
+    return "", "", err
+  } else {
+    secret := base64.URLEncoding.EncodeToString(bytes)
+    claim  := repository.Claim {
+      Address : address.String(),
+      Secret  : claimHash(secret),
+      Created : time.Now(),
+    }
+    if err := registry.repository.PutClaim(claim); err != nil {
+      return "", "", err
+    }
+    return registry.space.Formatter.Format(address), secret, nil
+  }
+}
+
+// verifies the given secret against the claim on the given address.
+// returns the address string, or ErrClaimRejected if the address is
+// not claimed or the secret does not match.
+func (registry ClaimRegistry) Claim(input string, secret string) (string, error) {
+  if address, err := Parse(input); err != nil {
+    return "", ErrClaimRejected
+  } else if claim, err := registry.repository.GetClaim(address.String()); err == repository.ErrNoSuchClaim {
+    return "", ErrClaimRejected
+  } else if err != nil {
+    return "", err
+  } else if subtle.ConstantTimeCompare([]byte(claim.Secret), []byte(claimHash(secret))) != 1 {
+    return "", ErrClaimRejected
+  } else {
+    return registry.space.Formatter.Format(address), nil
+  }
+}
+
+// creates a new claim registry for the given space.
+func NewClaimRegistry(repository repository.Repository, space AddressSpace) * ClaimRegistry {
+  registry := new(ClaimRegistry)
+  registry.repository = repository
+  registry.space      = space
+  return registry
+}
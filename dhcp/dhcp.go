@@ -28,17 +28,55 @@
 
 package dhcp
 
-import "bytes"
+import "sync"
+import "time"
+import "errors"
 import "strconv"
 import "repository"
+import "encoding/base64"
+
+// the number of addresses in the address space. conical wraps
+// ordinals at this bound, so allocators must not exceed it.
+const Capacity int64 = 256 * 256 * 256 * 256 * 256 * 256
+
+// remaining capacity below which the space is reported as low.
+const LowCapacity int64 = Capacity / 100
+
+// the number of addresses reserved for claims by default, the top
+// of the address space, in dotted form a.b.c.255.255.255.
+const DefaultReserved int64 = 256 * 256 * 256
+
+// returned when allocating past the end of the address space.
+type ExhaustedError struct {
+  Ordinal int64
+}
+func (err *ExhaustedError) Error() string {
+  return "address space exhausted at ordinal " + strconv.FormatInt(err.Ordinal, 10) + "."
+}
+
+// returns the capacity remaining after the given ordinal. Ordinals
+// in order reach the reserved addresses last, so the reserved 
+// addresses are taken from the capacity of the identity permutation.
+// Permuted ordinals land in the reserved range throughout, and are
+// skipped, so only the capacity is left for other permutations.
+func remaining(ordinal int64, space AddressSpace) int64 {
+  capacity := Capacity
+  if _, ok := space.Permutation.(IdentityPermutation); ok {
+    capacity -= space.Reserved
+  }
+  if ordinal >= capacity {
+    return 0
+  }
+  return capacity - ordinal
+}
 
 // computes the conical row major for the given
 // ordinal. returns an array of spatial indices
 // that constitutes an address in the address 
 // space. 
-func conical (ordinal int64) [6]int64 {
+func conical (ordinal int64) Address {
   var bounds = [6]int64 { 256, 256, 256, 256, 256, 256 }
-  var output = [6]int64 { 0, 0, 0, 0, 0, 0 }
+  var output = Address  { 0, 0, 0, 0, 0, 0 }
   var extent = [1]int64 { 1 }
   for i := 0; i < len(output); i++ {
     if(i > 0) { extent[0] *= bounds[i - 1] }
@@ -47,44 +85,433 @@ func conical (ordinal int64) [6]int64 {
   return output
 }
 
-// formats the given ordinal as a address string,
-// returns a IP like 6 component vector string 
-// given to users on connect.
-func format(ordinal int64) string {
-  var address = conical(ordinal)
-  var buffer bytes.Buffer
+// computes the ordinal for the given spatial 
+// indices, the inverse of conical.
+func inverse (address Address) int64 {
+  var ordinal int64 = 0
+  var extent  int64 = 1
   for i := 0; i < len(address); i++ {
-    buffer.WriteString(strconv.FormatInt(address[i], 10))
-    if(i != len(address) - 1) {
-      buffer.WriteString(".")
-    }
+    ordinal += address[i] * extent
+    extent  *= 256
   }
-  return buffer.String()
+  return ordinal
 }
 
 type AddressAllocator interface {
+  // returns the next address.
   Next() (string, error)
+  // renews the given address, issued at the given time.
+  Renew(address string, issued time.Time) error
+  // leases the given address, if not in use.
+  Acquire(address string) error
+  // releases the given address.
+  Release(address string) error
+  // returns the number of addresses not yet allocated.
+  Remaining() (int64, error)
 }
 type VirtualAddressAllocator struct {
   repository repository.Repository
+  space      AddressSpace
 }
-// returns the next address in this space.
+// returns the next address in this space. The ordinal is taken
+// atomically from the repository, so concurrent allocations 
+// never return the same address, and no address is returned if
+// the repository fails or the space is exhausted. Ordinals that
+// map to reserved addresses are skipped.
 func (allocator VirtualAddressAllocator) Next() (string, error) {
-  if result, err := allocator.repository.GetDhcpOrdinal(); err != nil {
-    return "", err
+  for skips := 0; ; skips++ {
+    if ordinal, err := allocator.repository.NextOrdinal(); err != nil {
+      return "", err
+    } else if ordinal >= Capacity || skips == maxReservedSkips {
+      return "", &ExhaustedError { Ordinal: ordinal }
+    } else if address, err := allocator.space.Address(ordinal); err != errReserved {
+      return address, err
+    }
+  }
+}
+// returns the number of addresses not yet allocated.
+func (allocator VirtualAddressAllocator) Remaining() (int64, error) {
+  if ordinal, err := allocator.repository.GetDhcpOrdinal(); err != nil {
+    return 0, err
   } else {
-    address := format(result)
-    result += 1
-    if err := allocator.repository.SetDhcpOrdinal(result); err != nil {
+    return remaining(ordinal, allocator.space), nil
+  }
+}
+// addresses are not leased, so reserved addresses are always free.
+func (allocator VirtualAddressAllocator) Acquire(address string) error {
+  return nil
+}
+// addresses are never reused, so there is nothing to renew.
+func (allocator VirtualAddressAllocator) Renew(address string, issued time.Time) error {
+  return nil
+}
+// addresses are never reused, so there is nothing to release.
+func (allocator VirtualAddressAllocator) Release(address string) error {
+  return nil
+}
+// creates a new virtual address allocator, mapping ordinals to
+// addresses in the given space.
+func NewVirtualAddressAllocator(repository repository.Repository, space AddressSpace) * VirtualAddressAllocator {
+  allocator := new(VirtualAddressAllocator)
+  allocator.repository = repository
+  allocator.space      = space
+  return allocator
+}
+
+// a block of ordinals leased from the repository. A block is
+// shared by the allocators of a instance, so that ordinals are
+// handed out from memory, and the repository is only written
+// to when the block runs out.
+type OrdinalBlock struct {
+  mutex sync.Mutex
+  next  int64
+  limit int64
+  size  int64
+}
+// creates a new empty block, leasing size ordinals at a time.
+func NewOrdinalBlock(size int64) * OrdinalBlock {
+  block := new(OrdinalBlock)
+  block.size = size
+  return block
+}
+
+type BlockAddressAllocator struct {
+  repository repository.Repository
+  space      AddressSpace
+  block      *OrdinalBlock
+}
+// returns the next address in the block, leasing a new block
+// from the repository when the current block runs out. Ordinals
+// remaining in a block are lost when the instance exits. Ordinals 
+// that map to reserved addresses are skipped.
+func (allocator BlockAddressAllocator) Next() (string, error) {
+  block := allocator.block
+  block.mutex.Lock()
+  defer block.mutex.Unlock()
+  for skips := 0; ; skips++ {
+    if block.next >= block.limit {
+      if start, err := allocator.repository.LeaseOrdinals(block.size); err != nil {
+        return "", err
+      } else {
+        block.next  = start
+        block.limit = start + block.size
+      }
+    }
+    ordinal := block.next
+    if ordinal >= Capacity || skips == maxReservedSkips {
+      return "", &ExhaustedError { Ordinal: ordinal }
+    }
+    block.next += 1
+    if address, err := allocator.space.Address(ordinal); err != errReserved {
+      return address, err
+    }
+  }
+}
+// returns the number of addresses not yet leased to a block.
+func (allocator BlockAddressAllocator) Remaining() (int64, error) {
+  if ordinal, err := allocator.repository.GetDhcpOrdinal(); err != nil {
+    return 0, err
+  } else {
+    return remaining(ordinal, allocator.space), nil
+  }
+}
+// addresses are not leased, so reserved addresses are always free.
+func (allocator BlockAddressAllocator) Acquire(address string) error {
+  return nil
+}
+// addresses are never reused, so there is nothing to renew.
+func (allocator BlockAddressAllocator) Renew(address string, issued time.Time) error {
+  return nil
+}
+// addresses are never reused, so there is nothing to release.
+func (allocator BlockAddressAllocator) Release(address string) error {
+  return nil
+}
+// creates a new block address allocator, allocating from the 
+// given block, mapping ordinals to addresses in the given space.
+func NewBlockAddressAllocator(repository repository.Repository, space AddressSpace, block *OrdinalBlock) * BlockAddressAllocator {
+  allocator := new(BlockAddressAllocator)
+  allocator.repository = repository
+  allocator.space      = space
+  allocator.block      = block
+  return allocator
+}
+
+// returned when renewing a address that is no longer leased to
+// the caller, as it was released, or has since been reclaimed.
+var ErrLeaseReleased = errors.New("address lease released.")
+
+// returned when acquiring a address leased to another caller.
+var ErrAddressInUse = errors.New("address in use.")
+
+// returned when renewing a lease with no public key bound to it.
+var ErrNoKey = errors.New("no key bound to address.")
+
+// implemented by allocators that bind client public keys to the
+// leases of the addresses they allocate. The key is dropped when
+// the address is leased again, so a address reused by another
+// client is never verified against the key of a old client.
+type KeyBinder interface {
+  // binds the given public key to the lease on the given address.
+  BindKey(address string, key []byte) error
+  // returns the public key bound to the lease on the given address,
+  // without renewing the lease.
+  Key(address string) ([]byte, error)
+  // renews the lease on the given address, returns its public key.
+  RenewKey(address string) ([]byte, error)
+}
+
+// timings for leased addresses. A lease not renewed within the
+// timeout expires. Expired and released addresses are held in
+// quarantine before reuse, so that messages sent to a old peer
+// are not delivered to the peer the address is reused by.
+type LeasePolicy struct {
+  Timeout    time.Duration
+  Quarantine time.Duration
+}
+
+// the default lease policy.
+var DefaultLeasePolicy = LeasePolicy {
+  Timeout    : 24 * time.Hour,
+  Quarantine : 1  * time.Hour,
+}
+
+// allocator tracking leases of allocated addresses. Addresses
+// are reused from expired or released leases once quarantined,
+// and otherwise taken from the given allocator. Leases are keyed
+// by the dotted form of the address, so survive a change of format,
+// and addresses are handed out in the format of the space.
+type LeaseAddressAllocator struct {
+  repository repository.Repository
+  space      AddressSpace
+  allocator  AddressAllocator
+  policy     LeasePolicy
+}
+// returns the lease on the given address. Leases written before 
+// leases were keyed by the dotted form are moved to the dotted form,
+// leaving the lease in the old form to be dropped once reclaimed.
+func (allocator LeaseAddressAllocator) get(address string) (repository.Lease, error) {
+  key, err := Canonical(address)
+  if err != nil {
+    return repository.Lease {}, repository.ErrNoSuchLease
+  }
+  lease, err := allocator.repository.GetLease(key)
+  if err == repository.ErrNoSuchLease && key != address {
+    if lease, err = allocator.repository.GetLease(address); err == nil {
+      lease.Address = key
+      err = allocator.repository.PutLease(lease)
+    }
+  }
+  return lease, err
+}
+// returns a reclaimed address if one is available, otherwise the
+// next address of the underlying allocator, leased to the caller.
+// Claimed addresses are reclaimed, but not reused, as are leases in 
+// an old form that were moved to the dotted form. Addresses already
+// leased are skipped, so a address handed out before the address 
+// space was permuted is never leased again while in use.
+func (allocator LeaseAddressAllocator) Next() (string, error) {
+  now := time.Now()
+  for {
+    if lease, ok, err := allocator.repository.ReclaimLease(now); err != nil {
+      return "", err
+    } else if ok && lease.Claimed {
+      continue
+    } else if ok {
+      if address, err := Parse(lease.Address); err != nil {
+        continue
+      } else if created, err := allocator.repository.CreateLease(allocator.create(address.String(), now, false)); err != nil {
+        return "", err
+      } else if !created {
+        continue
+      } else {
+        return allocator.space.Formatter.Format(address), nil
+      }
+    } else if address, err := allocator.allocator.Next(); err != nil {
+      return "", err
+    } else if key, err := Canonical(address); err != nil {
       return "", err
-    } else {
+    } else if created, err := allocator.repository.CreateLease(allocator.create(key, now, false)); err != nil {
+      return "", err
+    } else if created {
       return address, nil
     }
   }
 }
-// creates a new virtual address allocator.
-func NewVirtualAddressAllocator(repository repository.Repository) * VirtualAddressAllocator {
-  allocator := new(VirtualAddressAllocator)
+// leases the given address to the caller, if not in use. A address
+// is in use while leased and renewed within the timeout. The lease 
+// is written only if still not in use, so of callers racing to 
+// acquire a address, only one succeeds. Addresses acquired are 
+// claimed, so are not reused by Next once expired.
+func (allocator LeaseAddressAllocator) Acquire(address string) error {
+  now := time.Now()
+  if key, err := Canonical(address); err != nil {
+    return err
+  } else if _, err := allocator.get(address); err != nil && err != repository.ErrNoSuchLease {
+    return err
+  } else if acquired, err := allocator.repository.AcquireLease(allocator.create(key, now, true), now.Add(-allocator.policy.Timeout)); err != nil {
+    return err
+  } else if !acquired {
+    return ErrAddressInUse
+  }
+  return nil
+}
+// returns a new lease on the given address, in the dotted form.
+func (allocator LeaseAddressAllocator) create(key string, now time.Time, claimed bool) repository.Lease {
+  return repository.Lease {
+    Address  : key,
+    Created  : now,
+    LastSeen : now,
+    Expires  : now.Add(allocator.policy.Timeout + allocator.policy.Quarantine),
+    Claimed  : claimed,
+  }
+}
+// renews the lease on the given address, issued at the given 
+// time. returns ErrLeaseReleased if the address was released,
+// or leased again after issued, compared to the second as 
+// issue times are held in seconds. Renewals are only written once
+// a tenth of the timeout has passed since the last. Identities 
+// issued before leases were tracked have a zero issue time, and
+// their address, allocated before leases were written, is leased
+// to them on first renewal.
+func (allocator LeaseAddressAllocator) Renew(address string, issued time.Time) error {
+  now := time.Now()
+  if lease, err := allocator.get(address); err == repository.ErrNoSuchLease && issued.Unix() == 0 {
+    return allocator.adopt(address, now)
+  } else if err == repository.ErrNoSuchLease {
+    return ErrLeaseReleased
+  } else if err != nil {
+    return err
+  } else {
+    if !lease.Released.IsZero() || lease.Created.Unix() > issued.Unix() {
+      return ErrLeaseReleased
+    }
+    return allocator.touch(lease, now)
+  }
+}
+// leases the given address, allocated before leases were written,
+// to the caller. Addresses were then allocated in order, so only 
+// addresses below the recorded ordinal, and outside the reserved 
+// range held back for claims, are adopted. returns ErrLeaseReleased
+// for any other address, or if the address was leased meanwhile.
+func (allocator LeaseAddressAllocator) adopt(address string, now time.Time) error {
+  if parsed, err := Parse(address); err != nil || allocator.space.Reserves(parsed) {
+    return ErrLeaseReleased
+  } else if ordinal, err := allocator.repository.GetDhcpOrdinal(); err != nil {
+    return err
+  } else if parsed.Value() >= ordinal {
+    return ErrLeaseReleased
+  } else if created, err := allocator.repository.CreateLease(repository.Lease {
+    Address  : parsed.String(),
+    LastSeen : now,
+    Expires  : now.Add(allocator.policy.Timeout + allocator.policy.Quarantine),
+  }); err != nil {
+    return err
+  } else if !created {
+    return ErrLeaseReleased
+  }
+  return nil
+}
+// extends the given lease, once a tenth of the timeout has passed
+// since it was last extended. The lease is updated only if it has
+// not since been released or reclaimed, so a renewal racing a 
+// release never writes the lease back unreleased.
+func (allocator LeaseAddressAllocator) touch(lease repository.Lease, now time.Time) error {
+  if now.Sub(lease.LastSeen) < allocator.policy.Timeout / 10 {
+    return nil
+  }
+  lease.LastSeen = now
+  lease.Expires  = now.Add(allocator.policy.Timeout + allocator.policy.Quarantine)
+  if updated, err := allocator.repository.UpdateLease(lease); err != nil {
+    return err
+  } else if !updated {
+    return ErrLeaseReleased
+  }
+  return nil
+}
+// binds the given public key to the lease on the given address.
+func (allocator LeaseAddressAllocator) BindKey(address string, key []byte) error {
+  if lease, err := allocator.get(address); err == repository.ErrNoSuchLease {
+    return ErrLeaseReleased
+  } else if err != nil {
+    return err
+  } else {
+    lease.Key = base64.URLEncoding.EncodeToString(key)
+    if updated, err := allocator.repository.UpdateLease(lease); err != nil {
+      return err
+    } else if !updated {
+      return ErrLeaseReleased
+    }
+    return nil
+  }
+}
+// returns the lease on the given address, and the public key bound
+// to it. returns ErrLeaseReleased if the address was released, and
+// ErrNoKey if no key is bound to the lease.
+func (allocator LeaseAddressAllocator) key(address string) (repository.Lease, []byte, error) {
+  if lease, err := allocator.get(address); err == repository.ErrNoSuchLease {
+    return lease, nil, ErrLeaseReleased
+  } else if err != nil {
+    return lease, nil, err
+  } else if !lease.Released.IsZero() {
+    return lease, nil, ErrLeaseReleased
+  } else if lease.Key == "" {
+    return lease, nil, ErrNoKey
+  } else if key, err := base64.URLEncoding.DecodeString(lease.Key); err != nil {
+    return lease, nil, err
+  } else {
+    return lease, key, nil
+  }
+}
+// returns the public key bound to the lease on the given address, 
+// without renewing the lease, so keys are checked before renewal.
+func (allocator LeaseAddressAllocator) Key(address string) ([]byte, error) {
+  _, key, err := allocator.key(address)
+  return key, err
+}
+// renews the lease on the given address, returns the public key 
+// bound to it. returns ErrLeaseReleased if the address was 
+// released, and ErrNoKey if no key is bound to the lease.
+func (allocator LeaseAddressAllocator) RenewKey(address string) ([]byte, error) {
+  if lease, key, err := allocator.key(address); err != nil {
+    return nil, err
+  } else if err := allocator.touch(lease, time.Now()); err != nil {
+    return nil, err
+  } else {
+    return key, nil
+  }
+}
+// returns the number of addresses not yet allocated by the
+// underlying allocator, excluding addresses available for reuse.
+func (allocator LeaseAddressAllocator) Remaining() (int64, error) {
+  return allocator.allocator.Remaining()
+}
+// releases the lease on the given address, quarantining the 
+// address before reuse.
+func (allocator LeaseAddressAllocator) Release(address string) error {
+  now := time.Now()
+  if lease, err := allocator.get(address); err == repository.ErrNoSuchLease {
+    return nil
+  } else if err != nil {
+    return err
+  } else {
+    if !lease.Released.IsZero() {
+      return nil
+    }
+    lease.Released = now
+    lease.Expires  = now.Add(allocator.policy.Quarantine)
+    _, err := allocator.repository.UpdateLease(lease)
+    return err
+  }
+}
+// creates a new lease address allocator, allocating new addresses
+// from the given allocator, and handing out reused addresses in the
+// format of the given space.
+func NewLeaseAddressAllocator(repository repository.Repository, space AddressSpace, next AddressAllocator, policy LeasePolicy) * LeaseAddressAllocator {
+  allocator := new(LeaseAddressAllocator)
   allocator.repository = repository
+  allocator.space      = space
+  allocator.allocator  = next
+  allocator.policy     = policy
   return allocator
-}
\ No newline at end of file
+}
@@ -0,0 +1,289 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "sync"
+import "time"
+import "testing"
+import "repository"
+
+// the number of parallel allocations made by each test.
+const parallelAllocations = 4000
+
+// allocates from the given allocators in parallel, round robin, and
+// fails the test if any address is handed out twice.
+func allocateParallel(t *testing.T, allocators ...AddressAllocator) {
+  var mutex sync.Mutex
+  var group sync.WaitGroup
+  seen := make(map[string]bool)
+  for i := 0; i < parallelAllocations; i++ {
+    group.Add(1)
+    go func(allocator AddressAllocator) {
+      defer group.Done()
+      if address, err := allocator.Next(); err != nil {
+        t.Error(err)
+      } else {
+        mutex.Lock()
+        defer mutex.Unlock()
+        if seen[address] {
+          t.Errorf("address %s allocated twice", address)
+        }
+        seen[address] = true
+      }
+    }(allocators[i % len(allocators)])
+  }
+  group.Wait()
+  if len(seen) != parallelAllocations {
+    t.Fatalf("expected %d addresses, got %d", parallelAllocations, len(seen))
+  }
+}
+
+// returns the default address space over the given repository.
+func testSpace(store repository.Repository) AddressSpace {
+  return AddressSpace {
+    Permutation : NewFeistelPermutation(store),
+    Formatter   : DottedFormatter {},
+    Reserved    : DefaultReserved,
+  }
+}
+
+func TestVirtualAllocatorParallel(t *testing.T) {
+  store := repository.NewMemoryRepository()
+  allocateParallel(t, NewVirtualAddressAllocator(store, testSpace(store)))
+}
+
+func TestBlockAllocatorParallel(t *testing.T) {
+  store := repository.NewMemoryRepository()
+  // two instances, each leasing its own blocks from one repository.
+  allocateParallel(t,
+    NewBlockAddressAllocator(store, testSpace(store), NewOrdinalBlock(100)),
+    NewBlockAddressAllocator(store, testSpace(store), NewOrdinalBlock(100)),
+  )
+}
+
+func TestLeaseAllocatorParallel(t *testing.T) {
+  store := repository.NewMemoryRepository()
+  allocateParallel(t, NewLeaseAddressAllocator(store, testSpace(store), NewVirtualAddressAllocator(store, testSpace(store)), DefaultLeasePolicy))
+}
+
+// repository pausing after each lease read, widening the window 
+// between reading and writing a lease.
+type slowLeaseRepository struct {
+  *repository.MemoryRepository
+}
+func (store slowLeaseRepository) GetLease(address string) (repository.Lease, error) {
+  lease, err := store.MemoryRepository.GetLease(address)
+  time.Sleep(time.Millisecond)
+  return lease, err
+}
+
+func TestLeaseRenewRacingRelease(t *testing.T) {
+  store     := slowLeaseRepository { repository.NewMemoryRepository() }
+  // renewals are written on every renew.
+  allocator := NewLeaseAddressAllocator(store, testSpace(store), NewVirtualAddressAllocator(store, testSpace(store)), LeasePolicy { Timeout: time.Nanosecond, Quarantine: time.Hour })
+  for i := 0; i < 20; i++ {
+    address, err := allocator.Next()
+    if err != nil {
+      t.Fatal(err)
+    }
+    var group sync.WaitGroup
+    done := make(chan struct{})
+    for j := 0; j < 8; j++ {
+      group.Add(1)
+      go func() {
+        defer group.Done()
+        for {
+          select {
+            case <-done:
+              return
+            default:
+              allocator.Renew(address, time.Now())
+          }
+        }
+      }()
+    }
+    time.Sleep(2 * time.Millisecond)
+    if err := allocator.Release(address); err != nil {
+      t.Fatal(err)
+    }
+    close(done)
+    group.Wait()
+    if lease, err := store.GetLease(address); err != nil || lease.Released.IsZero() {
+      t.Fatalf("expected %s released, got %v %v", address, lease, err)
+    }
+  }
+}
+
+func TestLeaseAcquireParallel(t *testing.T) {
+  store     := slowLeaseRepository { repository.NewMemoryRepository() }
+  allocator := NewLeaseAddressAllocator(store, testSpace(store), NewVirtualAddressAllocator(store, testSpace(store)), DefaultLeasePolicy)
+  var group sync.WaitGroup
+  var mutex sync.Mutex
+  acquired := 0
+  for i := 0; i < 8; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      if err := allocator.Acquire("1.2.3.4.5.6"); err == nil {
+        mutex.Lock()
+        acquired++
+        mutex.Unlock()
+      } else if err != ErrAddressInUse {
+        t.Error(err)
+      }
+    }()
+  }
+  group.Wait()
+  if acquired != 1 {
+    t.Fatalf("expected one acquire, got %d", acquired)
+  }
+}
+
+func TestLeaseNextSkipsLeased(t *testing.T) {
+  store     := repository.NewMemoryRepository()
+  space     := testSpace(store)
+  allocator := NewLeaseAddressAllocator(store, space, NewVirtualAddressAllocator(store, space), DefaultLeasePolicy)
+  // addresses handed out in order before the permutation, still in use.
+  created := time.Unix(1, 0)
+  leased  := make(map[string]bool)
+  for ordinal := int64(0); ordinal < 4; ordinal++ {
+    address, err := space.Address(ordinal)
+    if err != nil {
+      t.Fatal(err)
+    }
+    leased[address] = true
+    if err := store.PutLease(repository.Lease { Address: address, Created: created, LastSeen: time.Now(), Expires: time.Now().Add(time.Hour) }); err != nil {
+      t.Fatal(err)
+    }
+  }
+  address, err := allocator.Next()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if leased[address] {
+    t.Fatalf("expected leased address skipped, got %s", address)
+  }
+  for address := range leased {
+    if lease, err := store.GetLease(address); err != nil || !lease.Created.Equal(created) {
+      t.Fatalf("expected lease on %s kept, got %v %v", address, lease, err)
+    }
+  }
+}
+
+func TestLeaseRenewUntracked(t *testing.T) {
+  store     := repository.NewMemoryRepository()
+  allocator := NewLeaseAddressAllocator(store, testSpace(store), NewVirtualAddressAllocator(store, testSpace(store)), DefaultLeasePolicy)
+  address, err := Parse("1.2.3.4.5.6")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // addresses never allocated, or reserved for claims, are not adopted.
+  for _, untracked := range []string { "1.2.3.4.5.6", AddressOf(Capacity - 1).String() } {
+    if err := allocator.Renew(untracked, time.Unix(0, 0)); err != ErrLeaseReleased {
+      t.Fatalf("expected %s not adopted, got %v", untracked, err)
+    }
+  }
+  if err := store.SetDhcpOrdinal(Capacity); err != nil {
+    t.Fatal(err)
+  }
+  if err := allocator.Renew(AddressOf(Capacity - 1).String(), time.Unix(0, 0)); err != ErrLeaseReleased {
+    t.Fatalf("expected reserved address not adopted, got %v", err)
+  }
+  if err := store.SetDhcpOrdinal(address.Value() + 1); err != nil {
+    t.Fatal(err)
+  }
+  if err := allocator.Renew("1.2.3.4.5.6", time.Now()); err != ErrLeaseReleased {
+    t.Fatalf("expected untracked address released, got %v", err)
+  }
+  // identities issued before leases were tracked adopt their address.
+  if err := allocator.Renew("1.2.3.4.5.6", time.Unix(0, 0)); err != nil {
+    t.Fatal(err)
+  }
+  if err := allocator.Renew("1.2.3.4.5.6", time.Unix(0, 0)); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestLeaseFormatChange(t *testing.T) {
+  store     := repository.NewMemoryRepository()
+  space     := testSpace(store)
+  space.Formatter = HexFormatter {}
+  allocator := NewLeaseAddressAllocator(store, space, NewVirtualAddressAllocator(store, space), DefaultLeasePolicy)
+  address, err := allocator.Next()
+  if err != nil {
+    t.Fatal(err)
+  }
+  parsed, err := Parse(address)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the lease is held under the dotted form, whatever the format.
+  if err := allocator.Acquire(parsed.String()); err != ErrAddressInUse {
+    t.Fatalf("expected %s in use, got %v", parsed.String(), err)
+  }
+  if err := allocator.Renew(parsed.String(), time.Now()); err != nil {
+    t.Fatal(err)
+  }
+  // leases written under the old format are moved on first use.
+  legacy := HexFormatter {}.Format(AddressOf(parsed.Value() + 1))
+  if err := store.PutLease(repository.Lease { Address: legacy, Created: time.Unix(1, 0), LastSeen: time.Now(), Expires: time.Now().Add(time.Hour) }); err != nil {
+    t.Fatal(err)
+  }
+  if err := allocator.Renew(legacy, time.Now()); err != nil {
+    t.Fatal(err)
+  }
+  if lease, err := store.GetLease(AddressOf(parsed.Value() + 1).String()); err != nil || lease.Address != AddressOf(parsed.Value() + 1).String() {
+    t.Fatalf("expected lease moved to the dotted form, got %v %v", lease, err)
+  }
+}
+
+func TestRemaining(t *testing.T) {
+  store := repository.NewMemoryRepository()
+  // permuted ordinals past the reserved count still allocate.
+  if err := store.SetDhcpOrdinal(Capacity - DefaultReserved + 1); err != nil {
+    t.Fatal(err)
+  }
+  allocator := NewVirtualAddressAllocator(store, testSpace(store))
+  if remaining, err := allocator.Remaining(); err != nil || remaining != DefaultReserved - 1 {
+    t.Fatalf("expected %d remaining, got %d %v", DefaultReserved - 1, remaining, err)
+  }
+  if _, err := allocator.Next(); err != nil {
+    t.Fatal(err)
+  }
+  // ordinals in order reach the reserved addresses last.
+  space := testSpace(store)
+  space.Permutation = IdentityPermutation {}
+  ordered := NewVirtualAddressAllocator(store, space)
+  if remaining, err := ordered.Remaining(); err != nil || remaining != 0 {
+    t.Fatalf("expected none remaining, got %d %v", remaining, err)
+  }
+  if _, err := ordered.Next(); err == nil {
+    t.Fatal("expected ordered allocation exhausted")
+  }
+}
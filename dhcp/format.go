@@ -0,0 +1,221 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "errors"
+import "strings"
+import "strconv"
+import "encoding/hex"
+import "encoding/base32"
+
+// returned when parsing a malformed address.
+var ErrInvalidAddress = errors.New("invalid address.")
+
+// formats addresses as address strings.
+type AddressFormatter interface {
+  // formats the given address as a address string.
+  Format(address Address) string
+  // parses the given address string, returns the address.
+  Parse(input string) (Address, error)
+}
+
+// the address formatters, by name.
+var Formatters = map[string] AddressFormatter {
+  "dotted" : DottedFormatter {},
+  "base32" : Base32Formatter {},
+  "hex"    : HexFormatter    {},
+  "words"  : WordFormatter   {},
+}
+
+// returns the value as 6 big endian bytes.
+func bytes6(value int64) []byte {
+  output := make([]byte, 6)
+  for i := 5; i >= 0; i-- {
+    output[i] = byte(value)
+    value >>= 8
+  }
+  return output
+}
+
+// returns the value of 6 big endian bytes.
+func value6(input []byte) int64 {
+  var value int64 = 0
+  for i := 0; i < 6; i++ {
+    value = value << 8 | int64(input[i])
+  }
+  return value
+}
+
+//-----------------------------------------------------
+// dotted: 5.0.0.0.0.0
+//-----------------------------------------------------
+
+// the IP like 6 component decimal form, ordered as conical.
+type DottedFormatter struct {}
+func (formatter DottedFormatter) Format(address Address) string {
+  return address.String()
+}
+func (formatter DottedFormatter) Parse(input string) (Address, error) {
+  var address Address
+  components := strings.Split(input, ".")
+  if len(components) != len(address) {
+    return address, ErrInvalidAddress
+  }
+  for i, component := range components {
+    if len(component) == 0 || len(component) > 3 || strings.TrimLeft(component, "0123456789") != "" {
+      return Address {}, ErrInvalidAddress
+    }
+    if octet, err := strconv.ParseInt(component, 10, 64); err != nil || octet > 255 {
+      return Address {}, ErrInvalidAddress
+    } else {
+      address[i] = octet
+    }
+  }
+  return address, nil
+}
+
+//-----------------------------------------------------
+// base32: aaaaaaaaau
+//-----------------------------------------------------
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// the compact 10 character base32 form.
+type Base32Formatter struct {}
+func (formatter Base32Formatter) Format(address Address) string {
+  return strings.ToLower(base32Encoding.EncodeToString(bytes6(address.Value())))
+}
+func (formatter Base32Formatter) Parse(input string) (Address, error) {
+  if len(input) != 10 {
+    return Address {}, ErrInvalidAddress
+  }
+  if bytes, err := base32Encoding.DecodeString(strings.ToUpper(input)); err != nil || len(bytes) != 6 {
+    return Address {}, ErrInvalidAddress
+  } else {
+    address := AddressOf(value6(bytes))
+    if formatter.Format(address) != strings.ToLower(input) {
+      return Address {}, ErrInvalidAddress
+    }
+    return address, nil
+  }
+}
+
+//-----------------------------------------------------
+// hex: 000000000005
+//-----------------------------------------------------
+
+// the 12 character hexadecimal form.
+type HexFormatter struct {}
+func (formatter HexFormatter) Format(address Address) string {
+  return hex.EncodeToString(bytes6(address.Value()))
+}
+func (formatter HexFormatter) Parse(input string) (Address, error) {
+  if len(input) != 12 {
+    return Address {}, ErrInvalidAddress
+  }
+  if bytes, err := hex.DecodeString(input); err != nil {
+    return Address {}, ErrInvalidAddress
+  } else {
+    return AddressOf(value6(bytes)), nil
+  }
+}
+
+//-----------------------------------------------------
+// words: alarm-acorn-acorn-acorn-acorn-acorn
+//-----------------------------------------------------
+
+// one word per octet, ordered as conical, for reading aloud.
+var words = [256]string {
+  "acorn", "actor", "adult", "agent", "air", "alarm", "album", "alley",
+  "amber", "angel", "ankle", "apple", "apron", "arch", "arena", "arm",
+  "army", "arrow", "art", "ash", "atlas", "atom", "aunt", "autumn",
+  "award", "axis", "baby", "bacon", "badge", "bag", "baker", "ball",
+  "bamboo", "band", "bank", "barn", "basin", "basket", "bat", "beach",
+  "bean", "bear", "beard", "bed", "bee", "beef", "bell", "belt",
+  "bench", "berry", "bike", "bird", "blade", "blanket", "block", "boat",
+  "body", "bone", "book", "boot", "bottle", "bowl", "box", "brain",
+  "branch", "bread", "brick", "bridge", "broom", "brush", "bucket", "bulb",
+  "bus", "butter", "cabin", "cable", "cake", "camel", "camera", "camp",
+  "candle", "canoe", "canyon", "cape", "card", "carpet", "carrot", "cart",
+  "castle", "cat", "cave", "cedar", "chain", "chair", "chalk", "cheese",
+  "cherry", "chess", "chest", "chin", "circle", "city", "clay", "cliff",
+  "clock", "cloud", "clown", "coal", "coast", "coat", "cobra", "coin",
+  "comet", "copper", "coral", "corn", "cotton", "cow", "crab", "crane",
+  "crow", "crown", "cube", "cup", "dagger", "daisy", "dance", "deer",
+  "desert", "desk", "diary", "dice", "doctor", "dog", "doll", "dolphin",
+  "donkey", "door", "dragon", "drum", "duck", "eagle", "ear", "earth",
+  "egg", "elbow", "elk", "ember", "engine", "eye", "fabric", "falcon",
+  "farm", "feather", "fence", "fern", "ferry", "field", "fig", "film",
+  "finch", "fire", "fish", "flag", "flame", "flute", "foam", "forest",
+  "fox", "frog", "fruit", "galaxy", "garden", "garlic", "gate", "gem",
+  "ghost", "giant", "ginger", "glass", "globe", "glove", "goat", "gold",
+  "goose", "grape", "grass", "guitar", "hammer", "harbor", "harp", "hat",
+  "hawk", "heart", "hill", "honey", "horse", "house", "ice", "igloo",
+  "ink", "iron", "island", "ivory", "jacket", "jade", "jar", "jelly",
+  "jewel", "judge", "juice", "kayak", "kettle", "key", "king", "kite",
+  "kiwi", "knife", "koala", "ladder", "lake", "lamp", "lemon", "lion",
+  "lizard", "lobster", "lock", "lotus", "magnet", "mango", "maple", "marble",
+  "mask", "meadow", "melon", "mint", "mirror", "monkey", "moon", "moose",
+  "moth", "mountain", "mouse", "music", "nail", "needle", "nest", "noodle",
+  "nut", "oak", "ocean", "olive", "onion", "orange", "otter", "owl",
+}
+
+// the word index of each word.
+var wordIndex = func() map[string] int64 {
+  index := make(map[string] int64)
+  for i, word := range words {
+    index[word] = int64(i)
+  }
+  return index
+}()
+
+// the 6 word form, for reading aloud.
+type WordFormatter struct {}
+func (formatter WordFormatter) Format(address Address) string {
+  components := make([]string, len(address))
+  for i := 0; i < len(address); i++ {
+    components[i] = words[address[i]]
+  }
+  return strings.Join(components, "-")
+}
+func (formatter WordFormatter) Parse(input string) (Address, error) {
+  var address Address
+  components := strings.Split(strings.ToLower(input), "-")
+  if len(components) != len(address) {
+    return address, ErrInvalidAddress
+  }
+  for i, component := range components {
+    if octet, ok := wordIndex[component]; !ok {
+      return Address {}, ErrInvalidAddress
+    } else {
+      address[i] = octet
+    }
+  }
+  return address, nil
+}
@@ -0,0 +1,133 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+
+package dhcp
+
+import "testing"
+import "math/rand"
+
+// address values covering the edges of the address space, and a 
+// spread of values between.
+func testValues() []int64 {
+  values := []int64 { 0, 1, 5, 255, 256, 65535, 65536, Capacity / 2, Capacity - 256, Capacity - 1 }
+  random := rand.New(rand.NewSource(1))
+  for i := 0; i < 64; i++ {
+    values = append(values, random.Int63n(Capacity))
+  }
+  return values
+}
+
+func TestFormatVectors(t *testing.T) {
+  // the examples of the address formats table.
+  address := AddressOf(5)
+  tests := []struct {
+    formatter AddressFormatter
+    expected  string
+  } {
+    { DottedFormatter {}, "5.0.0.0.0.0" },
+    { Base32Formatter {}, "aaaaaaaaau" },
+    { HexFormatter    {}, "000000000005" },
+    { WordFormatter   {}, "alarm-acorn-acorn-acorn-acorn-acorn" },
+  }
+  for _, test := range tests {
+    if output := test.formatter.Format(address); output != test.expected {
+      t.Errorf("%T: expected %s, got %s", test.formatter, test.expected, output)
+    }
+    if parsed, err := test.formatter.Parse(test.expected); err != nil || parsed != address {
+      t.Errorf("%T: expected %s parsed to %v, got %v %v", test.formatter, test.expected, address, parsed, err)
+    }
+  }
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+  for name, formatter := range Formatters {
+    for _, value := range testValues() {
+      address := AddressOf(value)
+      output  := formatter.Format(address)
+      if parsed, err := formatter.Parse(output); err != nil || parsed != address {
+        t.Fatalf("%s: expected %s parsed to %v, got %v %v", name, output, address, parsed, err)
+      }
+      // any format parses back to the same address, and value.
+      if parsed, err := Parse(output); err != nil || parsed != address || parsed.Value() != value {
+        t.Fatalf("%s: expected %s parsed to value %d, got %v %v", name, output, value, parsed, err)
+      }
+      if canonical, err := Canonical(output); err != nil || canonical != address.String() {
+        t.Fatalf("%s: expected %s canonical %s, got %s %v", name, output, address.String(), canonical, err)
+      }
+      checked := ChecksumFormatter { formatter }.Format(address)
+      if parsed, err := (ChecksumFormatter { formatter }).Parse(checked); err != nil || parsed != address {
+        t.Fatalf("%s: expected %s parsed to %v, got %v %v", name, checked, address, parsed, err)
+      }
+    }
+  }
+}
+
+func TestFormatRejects(t *testing.T) {
+  tests := []struct {
+    formatter AddressFormatter
+    input     string
+  } {
+    { DottedFormatter {}, "" },
+    { DottedFormatter {}, "1.2.3.4.5" },
+    { DottedFormatter {}, "1.2.3.4.5.6.7" },
+    { DottedFormatter {}, "1.2.3.4.5.256" },
+    { DottedFormatter {}, "1.2.3.4.5.-1" },
+    { DottedFormatter {}, "1.2.3.4.5.+1" },
+    { DottedFormatter {}, "1.2.3.4.5.0006" },
+    { DottedFormatter {}, "1..3.4.5.6" },
+    { DottedFormatter {}, "1.2.3.4.5.6." },
+    { DottedFormatter {}, "1.2.3.4.5. 6" },
+    { Base32Formatter {}, "aaaaaaaaa" },
+    { Base32Formatter {}, "aaaaaaaaaaa" },
+    { Base32Formatter {}, "aaaaaaaaa1" },
+    { Base32Formatter {}, "aaaaaaaaa=" },
+    // the trailing 2 bits of the last character are not zero.
+    { Base32Formatter {}, "aaaaaaaaav" },
+    { HexFormatter    {}, "00000000005" },
+    { HexFormatter    {}, "0000000000005" },
+    { HexFormatter    {}, "00000000000g" },
+    { HexFormatter    {}, "0x0000000005" },
+    { WordFormatter   {}, "alarm-acorn-acorn-acorn-acorn" },
+    { WordFormatter   {}, "alarm-acorn-acorn-acorn-acorn-acorn-acorn" },
+    { WordFormatter   {}, "alarm-acorn-acorn-acorn-acorn-zebra" },
+    { WordFormatter   {}, "alarm--acorn-acorn-acorn-acorn" },
+    { WordFormatter   {}, "alarm acorn acorn acorn acorn acorn" },
+  }
+  for _, test := range tests {
+    if parsed, err := test.formatter.Parse(test.input); err != ErrInvalidAddress {
+      t.Errorf("%T: expected %q rejected, got %v %v", test.formatter, test.input, parsed, err)
+    }
+  }
+  // base32 and words are case insensitive.
+  for _, input := range []string { "AAAAAAAAAU", "Alarm-ACORN-acorn-acorn-acorn-acorn" } {
+    if parsed, err := Parse(input); err != nil || parsed != AddressOf(5) {
+      t.Errorf("expected %s parsed to %v, got %v %v", input, AddressOf(5), parsed, err)
+    }
+  }
+}
@@ -0,0 +1,155 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package dhcp
+
+import "errors"
+import "crypto/hmac"
+import "crypto/sha256"
+import "repository"
+
+// a permutation of the address space, mapping allocation ordinals
+// to address values. Permutations are bijective on 0 to Capacity,
+// so distinct ordinals always map to distinct values.
+type Permutation interface {
+  // permutes the given ordinal, returns the address value.
+  Permute(ordinal int64) (int64, error)
+  // inverts the given address value, returns the ordinal.
+  Invert(value int64) (int64, error)
+}
+
+// maps each ordinal to itself, handing out addresses in order.
+type IdentityPermutation struct {}
+func (permutation IdentityPermutation) Permute(ordinal int64) (int64, error) {
+  return ordinal, nil
+}
+func (permutation IdentityPermutation) Invert(value int64) (int64, error) {
+  return value, nil
+}
+
+// number of rounds of the feistel network.
+const feistelRounds = 8
+
+// half of the 48 bit address value.
+const feistelHalf = 24
+const feistelMask = 1 << feistelHalf - 1
+
+// keyed format preserving permutation. A balanced feistel network
+// over the 48 bit address value, with a HMAC-SHA256 round function
+// keyed from the repository secret. Addresses handed out in order 
+// of ordinal appear random, and can not be enumerated, or used to
+// count connections, without the key.
+type FeistelPermutation struct {
+  repository repository.Repository
+}
+
+// derives the permutation key from the repository secret.
+func (permutation FeistelPermutation) key() ([]byte, error) {
+  if secret, err := permutation.repository.GetSecretKey(); err != nil {
+    return nil, err
+  } else {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("dhcp-permutation"))
+    return mac.Sum(nil), nil
+  }
+}
+
+// the round function, returns 24 bits.
+func feistelRound(key []byte, round int, half int64) int64 {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte { byte(round), byte(half >> 16), byte(half >> 8), byte(half) })
+  sum := mac.Sum(nil)
+  return (int64(sum[0]) << 16 | int64(sum[1]) << 8 | int64(sum[2])) & feistelMask
+}
+
+func (permutation FeistelPermutation) Permute(ordinal int64) (int64, error) {
+  if key, err := permutation.key(); err != nil {
+    return 0, err
+  } else {
+    left, right := (ordinal >> feistelHalf) & feistelMask, ordinal & feistelMask
+    for round := 0; round < feistelRounds; round++ {
+      left, right = right, left ^ feistelRound(key, round, right)
+    }
+    return left << feistelHalf | right, nil
+  }
+}
+func (permutation FeistelPermutation) Invert(value int64) (int64, error) {
+  if key, err := permutation.key(); err != nil {
+    return 0, err
+  } else {
+    left, right := (value >> feistelHalf) & feistelMask, value & feistelMask
+    for round := feistelRounds - 1; round >= 0; round-- {
+      left, right = right ^ feistelRound(key, round, left), left
+    }
+    return left << feistelHalf | right, nil
+  }
+}
+
+// creates a new feistel permutation keyed from the secret of the
+// given repository.
+func NewFeistelPermutation(repository repository.Repository) * FeistelPermutation {
+  permutation := new(FeistelPermutation)
+  permutation.repository = repository
+  return permutation
+}
+
+// returned by AddressSpace.Address for ordinals that map to a
+// reserved address, which allocators skip.
+var errReserved = errors.New("address reserved.")
+
+// the most reserved addresses skipped in a row before allocation
+// gives up. Permuted ordinals land in the reserved range rarely, so
+// a long run only occurs where sequential allocation reaches it.
+const maxReservedSkips = 64
+
+// the mapping of ordinals to address strings. Ordinals are 
+// permuted into address values, which are then formatted. The
+// top Reserved values are kept back for claims, and are never
+// handed out by allocation.
+type AddressSpace struct {
+  Permutation Permutation
+  Formatter   AddressFormatter
+  Reserved    int64
+}
+
+// returns true if the given address is in the reserved range.
+func (space AddressSpace) Reserves(address Address) bool {
+  return address.Value() >= Capacity - space.Reserved
+}
+
+// returns the address string for the given ordinal. returns 
+// errReserved if the ordinal maps to a reserved address.
+func (space AddressSpace) Address(ordinal int64) (string, error) {
+  if value, err := space.Permutation.Permute(ordinal); err != nil {
+    return "", err
+  } else if address := AddressOf(value); space.Reserves(address) {
+    return "", errReserved
+  } else {
+    return space.Formatter.Format(address), nil
+  }
+}
@@ -0,0 +1,164 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package encryption
+
+import "io"
+import "time"
+import "encoding/base64"
+import "encoding/binary"
+import "crypto/rand"
+import "crypto/aes"
+import "crypto/hmac"
+import "crypto/sha256"
+import "crypto/cipher"
+import "repository"
+
+// the version bytes leading AES-GCM tokens. Version 1 tokens are 
+// sealed with key 0, version 2 tokens name their key.
+const aeadVersion   byte = 1
+const aeadVersionId byte = 2
+
+// the time legacy AES-CFB tokens are accepted until by default,
+// after which the legacy provider may be removed.
+var DefaultLegacyCutoff = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+// authenticated AES-256-GCM provider. Tokens are the base64 of a
+// version byte, key id, nonce and sealed input, so a token changed 
+// in any way fails to decrypt. Tokens are sealed with the active 
+// key of the key ring, and decrypt while their key is in the ring.
+// Tokens of a legacy provider are accepted until the end of a 
+// migration window.
+type AeadEncryptionProvider struct {
+  repository repository.Repository
+  ring       *KeyRing
+  legacy     EncryptionProvider
+  until      time.Time
+}
+
+// returns the GCM cipher for the given key.
+func aead(key repository.Key) (cipher.AEAD, error) {
+  if secret, err := base64.URLEncoding.DecodeString(key.Value); err != nil {
+    return nil, err
+  } else {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("identity-aead"))
+    if block, err := aes.NewCipher(mac.Sum(nil)); err != nil {
+      return nil, err
+    } else {
+      return cipher.NewGCM(block)
+    }
+  }
+}
+
+// encrypts the given plain text input, returns base64 result.
+func (provider AeadEncryptionProvider) Encrypt(input string) (string, error) {
+  if key, err := provider.ring.Active(provider.repository); err != nil {
+    return "", err
+  } else if aead, err := aead(key); err != nil {
+    return "", err
+  } else {
+    header := make([]byte, 5 + aead.NonceSize())
+    header[0] = aeadVersionId
+    binary.BigEndian.PutUint32(header[1:5], uint32(key.Id))
+    if _, err := io.ReadFull(rand.Reader, header[5:]); err != nil {
+      return "", err
+    }
+    token := aead.Seal(header, header[5:], []byte(input), header[:5])
+    return base64.URLEncoding.EncodeToString(token), nil
+  }
+}
+
+// decrypts the given base64 input, returns plain text result. 
+// Tokens that fail to decrypt are passed to the legacy provider
+// while the migration window is open.
+func (provider AeadEncryptionProvider) Decrypt(input string) (string, error) {
+  if output, err := provider.open(input); err == ErrInvalidToken && provider.legacy != nil && time.Now().Before(provider.until) {
+    return provider.legacy.Decrypt(input)
+  } else {
+    return output, err
+  }
+}
+
+// opens the given base64 token. returns ErrInvalidToken if the 
+// token is malformed, tampered, or its key was retired.
+func (provider AeadEncryptionProvider) open(input string) (string, error) {
+  bytes, err := base64.URLEncoding.DecodeString(input)
+  if err != nil || len(bytes) == 0 {
+    return "", ErrInvalidToken
+  }
+  var id     int64
+  var header int
+  switch bytes[0] {
+    case aeadVersion:
+      id, header = 0, 1
+    case aeadVersionId:
+      if len(bytes) < 5 {
+        return "", ErrInvalidToken
+      }
+      id, header = int64(binary.BigEndian.Uint32(bytes[1:5])), 5
+    default:
+      return "", ErrInvalidToken
+  }
+  if key, err := provider.ring.Get(provider.repository, id); err == ErrUnknownKey {
+    return "", ErrInvalidToken
+  } else if err != nil {
+    return "", err
+  } else if aead, err := aead(key); err != nil {
+    return "", err
+  } else if len(bytes) < header + aead.NonceSize() + aead.Overhead() {
+    return "", ErrInvalidToken
+  } else if output, err := aead.Open(nil, bytes[header:header + aead.NonceSize()], bytes[header + aead.NonceSize():], bytes[:header]); err != nil {
+    return "", ErrInvalidToken
+  } else {
+    return string(output), nil
+  }
+}
+
+// adds a new active key to the key ring, retiring keys superseded
+// for longer than the retire period of the ring. returns the id of
+// the new key.
+func (provider AeadEncryptionProvider) Rotate() (int64, error) {
+  if key, err := provider.ring.Rotate(provider.repository); err != nil {
+    return 0, err
+  } else {
+    return key.Id, nil
+  }
+}
+
+// creates a new AES-GCM encryption provider, sealing tokens with
+// keys of the given key ring. Tokens of the given legacy provider, 
+// which may be nil, are accepted until the given time.
+func NewAeadEncryptionProvider(repository repository.Repository, ring *KeyRing, legacy EncryptionProvider, until time.Time) * AeadEncryptionProvider {
+  var provider = new(AeadEncryptionProvider)
+  provider.repository = repository
+  provider.ring       = ring
+  provider.legacy     = legacy
+  provider.until      = until
+  return provider
+}
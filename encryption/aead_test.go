@@ -0,0 +1,160 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package encryption
+
+import "time"
+import "testing"
+import "encoding/base64"
+import "repository"
+
+const testIdentity = `{"address":"1.2.3.4.5.6","issuedAt":1700000000}`
+
+// returns a provider over a new memory repository, accepting 
+// legacy tokens until the given time.
+func testProvider(until time.Time) (*AeadEncryptionProvider, *Aes256EncryptionProvider) {
+  store  := repository.NewMemoryRepository()
+  legacy := NewAesEncryptionProvider(store)
+  return NewAeadEncryptionProvider(store, NewKeyRing(DefaultKeyRefresh, time.Hour), legacy, until), legacy
+}
+
+func TestAeadRoundTrip(t *testing.T) {
+  provider, _ := testProvider(time.Time {})
+  token, err := provider.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if output, err := provider.Decrypt(token); err != nil || output != testIdentity {
+    t.Fatalf("expected %s, got %s %v", testIdentity, output, err)
+  }
+  // tokens sealed before a rotation decrypt until retired.
+  if _, err := provider.Rotate(); err != nil {
+    t.Fatal(err)
+  }
+  if output, err := provider.Decrypt(token); err != nil || output != testIdentity {
+    t.Fatalf("expected %s after rotation, got %s %v", testIdentity, output, err)
+  }
+  if rotated, err := provider.Encrypt(testIdentity); err != nil {
+    t.Fatal(err)
+  } else if output, err := provider.Decrypt(rotated); err != nil || output != testIdentity {
+    t.Fatalf("expected %s, got %s %v", testIdentity, output, err)
+  }
+}
+
+func TestAeadTamper(t *testing.T) {
+  provider, _ := testProvider(time.Time {})
+  token, err := provider.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  bytes, err := base64.URLEncoding.DecodeString(token)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := range bytes {
+    tampered := append([]byte(nil), bytes...)
+    tampered[i] ^= 0x01
+    if output, err := provider.Decrypt(base64.URLEncoding.EncodeToString(tampered)); err != ErrInvalidToken {
+      t.Fatalf("expected byte %d tampered rejected, got %s %v", i, output, err)
+    }
+  }
+  for _, length := range []int { 0, 1, 5, len(bytes) - 1 } {
+    if _, err := provider.Decrypt(base64.URLEncoding.EncodeToString(bytes[:length])); err != ErrInvalidToken {
+      t.Fatalf("expected token truncated to %d rejected, got %v", length, err)
+    }
+  }
+}
+
+func TestAeadLegacy(t *testing.T) {
+  provider, legacy := testProvider(time.Now().Add(time.Hour))
+  token, err := legacy.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if output, err := provider.Decrypt(token); err != nil || output != testIdentity {
+    t.Fatalf("expected legacy token accepted, got %s %v", output, err)
+  }
+  // legacy tokens are rejected once the cutoff has passed.
+  closed := NewAeadEncryptionProvider(provider.repository, provider.ring, legacy, time.Now().Add(-time.Second))
+  if _, err := closed.Decrypt(token); err != ErrInvalidToken {
+    t.Fatalf("expected legacy token rejected, got %v", err)
+  }
+}
+
+func FuzzDecrypt(f *testing.F) {
+  provider, _ := testProvider(time.Time {})
+  token, err := provider.Encrypt(testIdentity)
+  if err != nil {
+    f.Fatal(err)
+  }
+  f.Add(token)
+  f.Add("")
+  f.Add("AQ==")
+  f.Add("Ag==")
+  f.Add(token[:len(token) / 2])
+  f.Fuzz(func(t *testing.T, input string) {
+    // only tokens sealed by the provider decrypt, anything else is
+    // rejected as invalid.
+    if output, err := provider.Decrypt(input); err == nil && output != testIdentity {
+      t.Fatalf("decrypted %q to %q", input, output)
+    } else if err != nil && err != ErrInvalidToken {
+      t.Fatalf("expected %q invalid, got %v", input, err)
+    }
+  })
+}
+
+func FuzzDecryptLegacy(f *testing.F) {
+  provider, legacy := testProvider(time.Now().Add(24 * time.Hour))
+  token, err := legacy.Encrypt(testIdentity)
+  if err != nil {
+    f.Fatal(err)
+  }
+  f.Add(token)
+  // short and misaligned input, shorter than the iv, or not a whole
+  // number of blocks, or not whole base64 quanta.
+  f.Add("")
+  f.Add("A")
+  f.Add("AA")
+  f.Add("AQ")
+  f.Add("AAAA")
+  f.Add("AQ==")
+  f.Add(base64.URLEncoding.EncodeToString(make([]byte, 15)))
+  f.Add(base64.URLEncoding.EncodeToString(make([]byte, 16)))
+  f.Add(base64.URLEncoding.EncodeToString(make([]byte, 17)))
+  f.Add(token[:len(token) - 1])
+  f.Fuzz(func(t *testing.T, input string) {
+    // legacy tokens are not authenticated, so any input holding a iv
+    // decrypts, but input too short to hold one never does.
+    output, err := provider.Decrypt(input)
+    if bytes, decode := base64.URLEncoding.DecodeString(input); decode == nil && len(bytes) < 16 && err == nil {
+      t.Fatalf("expected %q shorter than the iv rejected, got %q", input, output)
+    } else if decode == nil && len(bytes) >= 16 && err == nil && len(output) > len(bytes) - 16 {
+      t.Fatalf("decrypted %q to %d bytes, longer than its ciphertext", input, len(output))
+    }
+  })
+}
@@ -36,6 +36,9 @@ import "crypto/cipher"
 import "repository"
 import "errors"
 
+// returned when decrypting a malformed or tampered token.
+var ErrInvalidToken = errors.New("invalid token.")
+
 type EncryptionProvider interface {
   // encrypts the given plain text input, returns base64 result.
   Encrypt(input string) (string, error)
@@ -43,6 +46,16 @@ type EncryptionProvider interface {
   Decrypt(input string) (string, error)
 }
 
+// implemented by providers with rotating keys.
+type Rotator interface {
+  // rotates the active key, returns the id of the new key.
+  Rotate() (int64, error)
+}
+
+// legacy AES-256-CFB provider. Tokens are not authenticated, so
+// bits flipped in a token flip the same bits of the plain text.
+// Use the AeadEncryptionProvider, which accepts tokens from this
+// provider while migrating.
 type Aes256EncryptionProvider struct {
   repository repository.Repository
 }
@@ -77,6 +90,9 @@ func (provider Aes256EncryptionProvider) Decrypt(input string) (string, error) {
   if bytes, err := base64.URLEncoding.DecodeString(input); err != nil {
     return "", err
   } else {
+    if len(bytes) < aes.BlockSize {
+      return "", ErrInvalidToken
+    }
     if key, err := provider.repository.GetSecretKey(); err != nil {
       return "", err
     } else {
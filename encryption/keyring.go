@@ -0,0 +1,209 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package encryption
+
+import "sync"
+import "time"
+import "sort"
+import "errors"
+import "repository"
+import "encoding/base64"
+
+// returned when a token names a key not in the key ring, as the
+// key was retired.
+var ErrUnknownKey = errors.New("unknown key.")
+
+// returned when a rotation finds no free key id, as rotations are
+// racing on many instances.
+var ErrRotateConflict = errors.New("key rotation conflict.")
+
+// how often a key ring reloads keys from the repository, so that
+// keys rotated by other instances are picked up.
+const DefaultKeyRefresh = time.Minute
+
+// how long keys decrypt tokens after being superseded by rotation.
+const DefaultKeyRetire = 7 * 24 * time.Hour
+
+// the keys used to seal identity tokens, held in the repository
+// and cached here. New tokens are sealed with the active key, the
+// newest, and older keys decrypt tokens until retired. A key ring
+// is shared by the providers of a instance, as a ordinal block is
+// shared by allocators.
+type KeyRing struct {
+  mutex   sync.Mutex
+  keys    []repository.Key
+  loaded  time.Time
+  forced  time.Time
+  refresh time.Duration
+  retire  time.Duration
+}
+
+// the most key ids a rotation tries before giving up, where ids
+// are taken by rotations racing on other instances.
+const maxRotateAttempts = 16
+
+// returns the keys, oldest first, loading them from the given 
+// repository if stale or forced. A empty ring is started with key 
+// 0, a copy of the repository secret, so tokens sealed before the
+// key ring was introduced still decrypt.
+func (ring *KeyRing) load(store repository.Repository, force bool) ([]repository.Key, error) {
+  ring.mutex.Lock()
+  defer ring.mutex.Unlock()
+  if ring.keys != nil && !force && time.Since(ring.loaded) < ring.refresh {
+    return ring.keys, nil
+  }
+  keys, err := store.GetKeys()
+  if err != nil {
+    return nil, err
+  }
+  if len(keys) == 0 {
+    if secret, err := store.GetSecretKey(); err != nil {
+      return nil, err
+    } else {
+      key := repository.Key {
+        Id      : 0,
+        Value   : base64.URLEncoding.EncodeToString(secret),
+        Created : time.Now(),
+      }
+      if added, err := store.AddKey(key); err != nil {
+        return nil, err
+      } else if !added {
+        // started by another instance.
+        if keys, err = store.GetKeys(); err != nil {
+          return nil, err
+        }
+      } else {
+        keys = []repository.Key { key }
+      }
+    }
+  }
+  sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+  ring.keys   = keys
+  ring.loaded = time.Now()
+  return keys, nil
+}
+
+// returns the active key.
+func (ring *KeyRing) Active(store repository.Repository) (repository.Key, error) {
+  if keys, err := ring.load(store, false); err != nil {
+    return repository.Key {}, err
+  } else {
+    return keys[len(keys) - 1], nil
+  }
+}
+
+// returns the keys in the ring, oldest first.
+func (ring *KeyRing) Keys(store repository.Repository) ([]repository.Key, error) {
+  return ring.load(store, false)
+}
+
+// returns true if a reload may be forced, at most once in each 
+// refresh interval, so tokens naming unknown keys do not reload 
+// the keys on every request.
+func (ring *KeyRing) forceable() bool {
+  ring.mutex.Lock()
+  defer ring.mutex.Unlock()
+  if now := time.Now(); now.Sub(ring.forced) < ring.refresh {
+    return false
+  } else {
+    ring.forced = now
+    return true
+  }
+}
+
+// returns the key with the given id, reloading the keys once if 
+// not found, as it may have been rotated in by another instance,
+// unless a reload was forced within the refresh interval. returns
+// ErrUnknownKey if there is no such key.
+func (ring *KeyRing) Get(store repository.Repository, id int64) (repository.Key, error) {
+  for _, force := range []bool { false, true } {
+    if force && !ring.forceable() {
+      break
+    }
+    if keys, err := ring.load(store, force); err != nil {
+      return repository.Key {}, err
+    } else {
+      for _, key := range keys {
+        if key.Id == id {
+          return key, nil
+        }
+      }
+    }
+  }
+  return repository.Key {}, ErrUnknownKey
+}
+
+// adds a new active key, and retires keys superseded for longer 
+// than the retire period of this ring. returns the new key. Keys
+// are added only if their id is free, so rotations racing on many
+// instances take the next free id rather than replacing a key.
+func (ring *KeyRing) Rotate(store repository.Repository) (repository.Key, error) {
+  keys, err := ring.load(store, true)
+  if err != nil {
+    return repository.Key {}, err
+  }
+  now := time.Now()
+  for i := 0; i < len(keys) - 1; i++ {
+    if now.Sub(keys[i + 1].Created) > ring.retire {
+      if err := store.DeleteKey(keys[i].Id); err != nil {
+        return repository.Key {}, err
+      }
+    }
+  }
+  if bytes, err := repository.GenerateRandomBytes(32); err != nil {
+    return repository.Key {}, err
+  } else {
+    key := repository.Key {
+      Id      : keys[len(keys) - 1].Id,
+      Value   : base64.URLEncoding.EncodeToString(bytes),
+      Created : now,
+    }
+    for attempt := 0; attempt < maxRotateAttempts; attempt++ {
+      key.Id++
+      if added, err := store.AddKey(key); err != nil {
+        return repository.Key {}, err
+      } else if added {
+        if _, err := ring.load(store, true); err != nil {
+          return repository.Key {}, err
+        }
+        return key, nil
+      }
+    }
+    return repository.Key {}, ErrRotateConflict
+  }
+}
+
+// creates a new key ring, reloading keys at the given refresh 
+// interval, and retiring keys the given period after rotation.
+func NewKeyRing(refresh time.Duration, retire time.Duration) * KeyRing {
+  ring := new(KeyRing)
+  ring.refresh = refresh
+  ring.retire  = retire
+  return ring
+}
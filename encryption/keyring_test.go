@@ -0,0 +1,98 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package encryption
+
+import "sync"
+import "time"
+import "testing"
+import "repository"
+
+// counts the key loads of the repository it wraps.
+type countingRepository struct {
+  *repository.MemoryRepository
+  mutex sync.Mutex
+  loads int
+}
+func (store *countingRepository) GetKeys() ([]repository.Key, error) {
+  store.mutex.Lock()
+  store.loads++
+  store.mutex.Unlock()
+  return store.MemoryRepository.GetKeys()
+}
+
+func TestKeyRingForcedReload(t *testing.T) {
+  store := &countingRepository { MemoryRepository: repository.NewMemoryRepository() }
+  ring  := NewKeyRing(time.Hour, time.Hour)
+  if _, err := ring.Active(store); err != nil {
+    t.Fatal(err)
+  }
+  // unknown keys force one reload in each refresh interval.
+  for i := 0; i < 100; i++ {
+    if _, err := ring.Get(store, 1000 + int64(i)); err != ErrUnknownKey {
+      t.Fatalf("expected unknown key, got %v", err)
+    }
+  }
+  if store.loads != 2 {
+    t.Fatalf("expected 2 loads, got %d", store.loads)
+  }
+}
+
+func TestKeyRingRotateRace(t *testing.T) {
+  store := repository.NewMemoryRepository()
+  var group sync.WaitGroup
+  var mutex sync.Mutex
+  seen := make(map[int64]string)
+  for i := 0; i < 8; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      // rings of separate instances over a shared repository.
+      if key, err := NewKeyRing(time.Hour, time.Hour).Rotate(store); err != nil {
+        t.Error(err)
+      } else {
+        mutex.Lock()
+        defer mutex.Unlock()
+        seen[key.Id] = key.Value
+      }
+    }()
+  }
+  group.Wait()
+  keys, err := store.GetKeys()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(seen) != 8 || len(keys) != 9 {
+    t.Fatalf("expected 8 rotated keys, got %d of %d", len(seen), len(keys))
+  }
+  for _, key := range keys {
+    if value, ok := seen[key.Id]; ok && value != key.Value {
+      t.Fatalf("expected key %d held, was replaced", key.Id)
+    }
+  }
+}
@@ -0,0 +1,258 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package encryption
+
+import "time"
+import "errors"
+import "strings"
+import "strconv"
+import "encoding/json"
+import "encoding/base64"
+import "crypto/hmac"
+import "crypto/sha256"
+import "crypto/ed25519"
+import "repository"
+
+// the signing algorithms of signed tokens, as named in the token
+// header.
+const HS256 = "HS256"
+const EdDSA = "EdDSA"
+
+// returned when creating a signed token provider with a unknown
+// algorithm.
+var ErrUnknownAlgorithm = errors.New("unknown signing algorithm.")
+
+// returned when verifying a signed token whose exp claim has passed.
+var ErrExpiredToken = errors.New("token expired.")
+
+// the registered expiry claim of a signed token, in unix seconds.
+type tokenClaims struct {
+  Exp int64 `json:"exp"`
+}
+
+// implemented by providers that publish keys, so that tokens can
+// be verified offline by other services.
+type Publisher interface {
+  // returns the keys verifying tokens, as a json web key set.
+  PublicKeys() (KeySet, error)
+}
+
+// a json web key, as published by a publisher.
+type JsonWebKey struct {
+  Kty string `json:"kty"`
+  Crv string `json:"crv"`
+  Kid string `json:"kid"`
+  Use string `json:"use"`
+  Alg string `json:"alg"`
+  X   string `json:"x"`
+}
+
+// a json web key set.
+type KeySet struct {
+  Keys []JsonWebKey `json:"keys"`
+}
+
+// the header of a signed token.
+type tokenHeader struct {
+  Alg string `json:"alg"`
+  Typ string `json:"typ"`
+  Kid string `json:"kid"`
+}
+
+// signed token provider. Rather than encrypting the input, tokens
+// are the input signed in the compact json web token form, the 
+// base64url header, input and signature joined by dots. Tokens 
+// are signed with HMAC-SHA256 or Ed25519 keys derived from the 
+// active key of the key ring, and verify while their key is in 
+// the ring. Ed25519 tokens can be verified by other services with
+// the published public keys. The input is readable by anyone 
+// holding a token, so must not hold secrets.
+type SignedTokenProvider struct {
+  repository repository.Repository
+  ring       *KeyRing
+  algorithm  string
+}
+
+// derives the signing key of the given purpose from the given key.
+func derive(key repository.Key, purpose string) ([]byte, error) {
+  if secret, err := base64.URLEncoding.DecodeString(key.Value); err != nil {
+    return nil, err
+  } else {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(purpose))
+    return mac.Sum(nil), nil
+  }
+}
+
+// returns the ed25519 private key derived from the given key.
+func ed25519Key(key repository.Key) (ed25519.PrivateKey, error) {
+  if seed, err := derive(key, "identity-ed25519"); err != nil {
+    return nil, err
+  } else {
+    return ed25519.NewKeyFromSeed(seed), nil
+  }
+}
+
+// signs the given input with the given key.
+func (provider SignedTokenProvider) sign(key repository.Key, input []byte) ([]byte, error) {
+  if provider.algorithm == EdDSA {
+    if private, err := ed25519Key(key); err != nil {
+      return nil, err
+    } else {
+      return ed25519.Sign(private, input), nil
+    }
+  }
+  if secret, err := derive(key, "identity-hs256"); err != nil {
+    return nil, err
+  } else {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write(input)
+    return mac.Sum(nil), nil
+  }
+}
+
+// verifies the given signature of the given input with the given key.
+func (provider SignedTokenProvider) verify(key repository.Key, input []byte, signature []byte) (bool, error) {
+  if provider.algorithm == EdDSA {
+    if private, err := ed25519Key(key); err != nil {
+      return false, err
+    } else {
+      return ed25519.Verify(private.Public().(ed25519.PublicKey), input, signature), nil
+    }
+  }
+  if expected, err := provider.sign(key, input); err != nil {
+    return false, err
+  } else {
+    return hmac.Equal(expected, signature), nil
+  }
+}
+
+// signs the given input, returns the compact token.
+func (provider SignedTokenProvider) Encrypt(input string) (string, error) {
+  if key, err := provider.ring.Active(provider.repository); err != nil {
+    return "", err
+  } else if header, err := json.Marshal(tokenHeader { Alg: provider.algorithm, Typ: "JWT", Kid: strconv.FormatInt(key.Id, 10) }); err != nil {
+    return "", err
+  } else {
+    content := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString([]byte(input))
+    if signature, err := provider.sign(key, []byte(content)); err != nil {
+      return "", err
+    } else {
+      return content + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+    }
+  }
+}
+
+// verifies the given compact token, returns the signed input. 
+// returns ErrInvalidToken if the token is malformed, not signed
+// with the algorithm of this provider, its key was retired, or
+// the signature does not match, and ErrExpiredToken if the input 
+// holds a exp claim that has passed.
+func (provider SignedTokenProvider) Decrypt(input string) (string, error) {
+  var header tokenHeader
+  parts := strings.Split(input, ".")
+  if len(parts) != 3 {
+    return "", ErrInvalidToken
+  }
+  if bytes, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(bytes, &header) != nil || header.Alg != provider.algorithm {
+    return "", ErrInvalidToken
+  }
+  if id, err := strconv.ParseInt(header.Kid, 10, 64); err != nil {
+    return "", ErrInvalidToken
+  } else if key, err := provider.ring.Get(provider.repository, id); err == ErrUnknownKey {
+    return "", ErrInvalidToken
+  } else if err != nil {
+    return "", err
+  } else if signature, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+    return "", ErrInvalidToken
+  } else if ok, err := provider.verify(key, []byte(parts[0] + "." + parts[1]), signature); err != nil {
+    return "", err
+  } else if !ok {
+    return "", ErrInvalidToken
+  } else if output, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+    return "", ErrInvalidToken
+  } else {
+    var claims tokenClaims
+    if json.Unmarshal(output, &claims) == nil && claims.Exp != 0 && !time.Now().Before(time.Unix(claims.Exp, 0)) {
+      return "", ErrExpiredToken
+    }
+    return string(output), nil
+  }
+}
+
+// adds a new active key to the key ring. returns the id of the 
+// new key.
+func (provider SignedTokenProvider) Rotate() (int64, error) {
+  if key, err := provider.ring.Rotate(provider.repository); err != nil {
+    return 0, err
+  } else {
+    return key.Id, nil
+  }
+}
+
+// returns the public keys of the key ring. HMAC-SHA256 keys are 
+// secret, so none are published.
+func (provider SignedTokenProvider) PublicKeys() (KeySet, error) {
+  set := KeySet { Keys: []JsonWebKey {} }
+  if provider.algorithm != EdDSA {
+    return set, nil
+  }
+  if keys, err := provider.ring.Keys(provider.repository); err != nil {
+    return set, err
+  } else {
+    for _, key := range keys {
+      if private, err := ed25519Key(key); err != nil {
+        return set, err
+      } else {
+        set.Keys = append(set.Keys, JsonWebKey {
+          Kty : "OKP",
+          Crv : "Ed25519",
+          Kid : strconv.FormatInt(key.Id, 10),
+          Use : "sig",
+          Alg : EdDSA,
+          X   : base64.RawURLEncoding.EncodeToString(private.Public().(ed25519.PublicKey)),
+        })
+      }
+    }
+    return set, nil
+  }
+}
+
+// creates a new signed token provider, signing with the given 
+// algorithm, HS256 or EdDSA, and keys of the given key ring.
+func NewSignedTokenProvider(repository repository.Repository, ring *KeyRing, algorithm string) (* SignedTokenProvider, error) {
+  if algorithm != HS256 && algorithm != EdDSA {
+    return nil, ErrUnknownAlgorithm
+  }
+  var provider = new(SignedTokenProvider)
+  provider.repository = repository
+  provider.ring       = ring
+  provider.algorithm  = algorithm
+  return provider, nil
+}
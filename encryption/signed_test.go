@@ -0,0 +1,199 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+
+package encryption
+
+import "time"
+import "strings"
+import "strconv"
+import "testing"
+import "encoding/base64"
+import "repository"
+
+// joins the given header, payload and signature as a compact token.
+func compact(header string, payload string, signature []byte) string {
+  return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// returns a signed token provider over the given repository.
+func testSigned(t *testing.T, store repository.Repository, ring *KeyRing, algorithm string) *SignedTokenProvider {
+  provider, err := NewSignedTokenProvider(store, ring, algorithm)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return provider
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+  for _, algorithm := range []string { HS256, EdDSA } {
+    provider := testSigned(t, repository.NewMemoryRepository(), NewKeyRing(DefaultKeyRefresh, time.Hour), algorithm)
+    if token, err := provider.Encrypt(testIdentity); err != nil {
+      t.Fatal(err)
+    } else if output, err := provider.Decrypt(token); err != nil || output != testIdentity {
+      t.Fatalf("%s: expected %s, got %s %v", algorithm, testIdentity, output, err)
+    }
+  }
+}
+
+func TestSignedTamper(t *testing.T) {
+  for _, algorithm := range []string { HS256, EdDSA } {
+    provider := testSigned(t, repository.NewMemoryRepository(), NewKeyRing(DefaultKeyRefresh, time.Hour), algorithm)
+    token, err := provider.Encrypt(testIdentity)
+    if err != nil {
+      t.Fatal(err)
+    }
+    parts := strings.Split(token, ".")
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+      t.Fatal(err)
+    }
+    for i := range signature {
+      tampered := append([]byte(nil), signature...)
+      tampered[i] ^= 0x01
+      if _, err := provider.Decrypt(parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(tampered)); err != ErrInvalidToken {
+        t.Fatalf("%s: expected signature byte %d tampered rejected, got %v", algorithm, i, err)
+      }
+    }
+    forged := base64.RawURLEncoding.EncodeToString([]byte(`{"address":"6.5.4.3.2.1","issuedAt":1700000000}`))
+    tests := map[string]string {
+      "forged payload"     : parts[0] + "." + forged + "." + parts[2],
+      "empty signature"    : parts[0] + "." + parts[1] + ".",
+      "truncated signature": parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2]) / 2],
+      "missing part"       : parts[0] + "." + parts[1],
+      "extra part"         : token + "." + parts[2],
+      "bad base64"         : parts[0] + "." + parts[1] + ".!!!!",
+    }
+    for name, input := range tests {
+      if _, err := provider.Decrypt(input); err != ErrInvalidToken {
+        t.Fatalf("%s: expected %s rejected, got %v", algorithm, name, err)
+      }
+    }
+  }
+}
+
+func TestSignedAlgorithm(t *testing.T) {
+  store   := repository.NewMemoryRepository()
+  ring    := NewKeyRing(DefaultKeyRefresh, time.Hour)
+  hs256   := testSigned(t, store, ring, HS256)
+  eddsa   := testSigned(t, store, ring, EdDSA)
+  hmac, err := hs256.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  signed, err := eddsa.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // tokens of another algorithm, over the same keys, are rejected.
+  if _, err := eddsa.Decrypt(hmac); err != ErrInvalidToken {
+    t.Fatalf("expected HS256 token rejected by EdDSA provider, got %v", err)
+  }
+  if _, err := hs256.Decrypt(signed); err != ErrInvalidToken {
+    t.Fatalf("expected EdDSA token rejected by HS256 provider, got %v", err)
+  }
+  parts := strings.Split(signed, ".")
+  tests := map[string]string {
+    "alg none unsigned"  : compact(`{"alg":"none","typ":"JWT","kid":"0"}`, testIdentity, nil),
+    "alg none signed"    : compact(`{"alg":"none","typ":"JWT","kid":"0"}`, testIdentity, []byte("x")),
+    "alg missing"        : compact(`{"typ":"JWT","kid":"0"}`, testIdentity, nil),
+    "alg lowercase"      : compact(`{"alg":"eddsa","typ":"JWT","kid":"0"}`, testIdentity, nil),
+    "alg swapped"        : base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"0"}`)) + "." + parts[1] + "." + parts[2],
+    "header not json"    : compact(`alg`, testIdentity, nil),
+  }
+  for name, input := range tests {
+    if _, err := eddsa.Decrypt(input); err != ErrInvalidToken {
+      t.Fatalf("expected %s rejected, got %v", name, err)
+    }
+  }
+}
+
+func TestSignedKeyId(t *testing.T) {
+  store    := repository.NewMemoryRepository()
+  provider := testSigned(t, store, NewKeyRing(DefaultKeyRefresh, time.Nanosecond), EdDSA)
+  token, err := provider.Encrypt(testIdentity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  parts := strings.Split(token, ".")
+  for _, kid := range []string { "99", "-1", "abc", "" } {
+    header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT","kid":"` + kid + `"}`))
+    if _, err := provider.Decrypt(header + "." + parts[1] + "." + parts[2]); err != ErrInvalidToken {
+      t.Fatalf("expected unknown kid %q rejected, got %v", kid, err)
+    }
+  }
+  // tokens of a retired key are rejected, once a later rotation 
+  // retires it.
+  if _, err := provider.Rotate(); err != nil {
+    t.Fatal(err)
+  }
+  if output, err := provider.Decrypt(token); err != nil || output != testIdentity {
+    t.Fatalf("expected token of superseded key accepted, got %s %v", output, err)
+  }
+  time.Sleep(time.Millisecond)
+  if id, err := provider.Rotate(); err != nil {
+    t.Fatal(err)
+  } else if keys, err := store.GetKeys(); err != nil {
+    t.Fatal(err)
+  } else {
+    for _, key := range keys {
+      if key.Id == 0 {
+        t.Fatalf("expected key 0 retired by rotation to %s, got %v", strconv.FormatInt(id, 10), keys)
+      }
+    }
+  }
+  if _, err := provider.Decrypt(token); err != ErrInvalidToken {
+    t.Fatalf("expected token of retired key rejected, got %v", err)
+  }
+}
+
+func TestSignedExpiry(t *testing.T) {
+  for _, algorithm := range []string { HS256, EdDSA } {
+    provider := testSigned(t, repository.NewMemoryRepository(), NewKeyRing(DefaultKeyRefresh, time.Hour), algorithm)
+    tests := []struct {
+      name     string
+      exp      int64
+      expected error
+    } {
+      { "expired",        time.Now().Add(-time.Minute).Unix(), ErrExpiredToken },
+      { "expiring now",   time.Now().Unix() - 1,               ErrExpiredToken },
+      { "unexpired",      time.Now().Add(time.Minute).Unix(),  nil },
+      { "no exp",         0,                                   nil },
+    }
+    for _, test := range tests {
+      input := `{"address":"1.2.3.4.5.6","exp":` + strconv.FormatInt(test.exp, 10) + `}`
+      if token, err := provider.Encrypt(input); err != nil {
+        t.Fatal(err)
+      } else if output, err := provider.Decrypt(token); err != test.expected {
+        t.Fatalf("%s %s: expected %v, got %v", algorithm, test.name, test.expected, err)
+      } else if err == nil && output != input {
+        t.Fatalf("%s %s: expected %s, got %s", algorithm, test.name, input, output)
+      }
+    }
+  }
+}
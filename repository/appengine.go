@@ -0,0 +1,334 @@
+// +build appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "appengine"
+import "appengine/datastore"
+import "time"
+import "strconv"
+import "encoding/base64"
+
+//-----------------------------------------------------
+// internally cached secret key. 
+//-----------------------------------------------------
+var CACHED_SECRET_KEY []byte = nil
+
+type AppEngineRepository struct {
+  context appengine.Context
+}
+func (repository AppEngineRepository) GetDhcpOrdinal() (int64, error) {
+  var key = datastore.NewKey(repository.context, "DHCP", "0", 0, nil)
+  var record = new(DHCP)
+  if err := datastore.Get(repository.context, key, record); err != nil && err != datastore.ErrNoSuchEntity {
+    return 0, err
+  }
+  return record.Ordinal, nil
+}
+func (repository AppEngineRepository) SetDhcpOrdinal(ordinal int64) (error) {
+  var key = datastore.NewKey(repository.context, "DHCP", "0", 0, nil)
+  var record = new(DHCP)
+  record.Ordinal = ordinal
+  if _, err := datastore.Put(repository.context, key, record); err != nil {
+    return err  
+  }
+  return nil
+}
+// atomically increments the ordinal in a datastore transaction, 
+// returns the ordinal prior to the increment.
+func (repository AppEngineRepository) NextOrdinal() (int64, error) {
+  return repository.LeaseOrdinals(1)
+}
+// atomically advances the ordinal by count in a datastore 
+// transaction, returns the first ordinal of the leased block.
+func (repository AppEngineRepository) LeaseOrdinals(count int64) (int64, error) {
+  var key = datastore.NewKey(repository.context, "DHCP", "0", 0, nil)
+  var ordinal int64
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var record = new(DHCP)
+    if err := datastore.Get(context, key, record); err != nil && err != datastore.ErrNoSuchEntity {
+      return err
+    }
+    ordinal = record.Ordinal
+    record.Ordinal += count
+    _, err := datastore.Put(context, key, record)
+    return err
+  }, nil)
+  if err != nil {
+    return 0, err
+  }
+  return ordinal, nil
+}
+// gets the aes secret key. If the key does not exist, this 
+// function will create with a random key.
+func (repository AppEngineRepository) GetSecretKey() ([]byte, error) {
+  // check the cache for the key.
+	if CACHED_SECRET_KEY != nil {
+		return CACHED_SECRET_KEY, nil
+	}
+	var key    = datastore.NewKey(repository.context, "SECRET", "0", 0, nil)
+	var record = new(SECRET)
+	if err := datastore.Get(repository.context, key, record); err != nil {
+    if err != datastore.ErrNoSuchEntity {
+      return nil, err
+    }
+    if bytes, err := GenerateRandomBytes(32); err != nil {
+			return nil, err
+		} else {
+      record.Value = base64.URLEncoding.EncodeToString(bytes)
+      if _, err := datastore.Put(repository.context, key, record); err != nil {
+        return nil, err
+      } else {
+        CACHED_SECRET_KEY = bytes
+        return CACHED_SECRET_KEY, nil
+      }
+    }
+	} else {
+		if bytes, err := base64.URLEncoding.DecodeString(record.Value); err != nil {
+			return nil, err 
+		} else {
+      CACHED_SECRET_KEY = bytes
+      return CACHED_SECRET_KEY, nil
+    }
+	}
+}
+
+func (repository AppEngineRepository) PutLease(lease Lease) (error) {
+  var key = datastore.NewKey(repository.context, "LEASE", lease.Address, 0, nil)
+  _, err := datastore.Put(repository.context, key, &lease)
+  return err
+}
+func (repository AppEngineRepository) GetLease(address string) (Lease, error) {
+  var key = datastore.NewKey(repository.context, "LEASE", address, 0, nil)
+  var lease Lease
+  if err := datastore.Get(repository.context, key, &lease); err == datastore.ErrNoSuchEntity {
+    return lease, ErrNoSuchLease
+  } else {
+    return lease, err
+  }
+}
+// removes and returns a lease that expired before now. The 
+// candidate is found by query, then removed in a transaction
+// that checks it has not since been renewed or reclaimed.
+func (repository AppEngineRepository) ReclaimLease(now time.Time) (Lease, bool, error) {
+  var lease Lease
+  var query = datastore.NewQuery("LEASE").Filter("Expires <", now).Limit(1).KeysOnly()
+  if keys, err := query.GetAll(repository.context, nil); err != nil || len(keys) == 0 {
+    return lease, false, err
+  } else {
+    var found = false
+    err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+      found = false
+      if err := datastore.Get(context, keys[0], &lease); err == datastore.ErrNoSuchEntity {
+        return nil
+      } else if err != nil {
+        return err
+      }
+      if !lease.Expires.Before(now) {
+        return nil
+      }
+      found = true
+      return datastore.Delete(context, keys[0])
+    }, nil)
+    if err != nil || !found {
+      return Lease {}, false, err
+    }
+    return lease, true, nil
+  }
+}
+
+// replaces the lease on the address of the given lease in a 
+// transaction, if the lease held was created at the same time, 
+// and is not released. returns false if not.
+func (repository AppEngineRepository) UpdateLease(lease Lease) (bool, error) {
+  var key = datastore.NewKey(repository.context, "LEASE", lease.Address, 0, nil)
+  var updated = false
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var held Lease
+    updated = false
+    if err := datastore.Get(context, key, &held); err == datastore.ErrNoSuchEntity {
+      return nil
+    } else if err != nil {
+      return err
+    } else if !held.Created.Equal(lease.Created) || !held.Released.IsZero() {
+      return nil
+    }
+    updated = true
+    _, err := datastore.Put(context, key, &lease)
+    return err
+  }, nil)
+  return updated && err == nil, err
+}
+
+// writes the given lease in a transaction, if no lease is held on
+// its address. returns false if one is.
+func (repository AppEngineRepository) CreateLease(lease Lease) (bool, error) {
+  var key = datastore.NewKey(repository.context, "LEASE", lease.Address, 0, nil)
+  var created = false
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var held Lease
+    created = false
+    if err := datastore.Get(context, key, &held); err == nil {
+      return nil
+    } else if err != datastore.ErrNoSuchEntity {
+      return err
+    }
+    created = true
+    _, err := datastore.Put(context, key, &lease)
+    return err
+  }, nil)
+  return created && err == nil, err
+}
+
+// writes the given lease in a transaction, if no lease is held on
+// its address, or the lease held was released, or last seen at or
+// before stale. returns false if not.
+func (repository AppEngineRepository) AcquireLease(lease Lease, stale time.Time) (bool, error) {
+  var key = datastore.NewKey(repository.context, "LEASE", lease.Address, 0, nil)
+  var acquired = false
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var held Lease
+    acquired = false
+    if err := datastore.Get(context, key, &held); err == nil && held.Released.IsZero() && held.LastSeen.After(stale) {
+      return nil
+    } else if err != nil && err != datastore.ErrNoSuchEntity {
+      return err
+    }
+    acquired = true
+    _, err := datastore.Put(context, key, &lease)
+    return err
+  }, nil)
+  return acquired && err == nil, err
+}
+
+func (repository AppEngineRepository) PutClaim(claim Claim) (error) {
+  var key = datastore.NewKey(repository.context, "CLAIM", claim.Address, 0, nil)
+  _, err := datastore.Put(repository.context, key, &claim)
+  return err
+}
+func (repository AppEngineRepository) GetClaim(address string) (Claim, error) {
+  var key = datastore.NewKey(repository.context, "CLAIM", address, 0, nil)
+  var claim Claim
+  if err := datastore.Get(repository.context, key, &claim); err == datastore.ErrNoSuchEntity {
+    return claim, ErrNoSuchClaim
+  } else {
+    return claim, err
+  }
+}
+
+func (repository AppEngineRepository) GetKeys() ([]Key, error) {
+  var keys []Key
+  if _, err := datastore.NewQuery("KEY").GetAll(repository.context, &keys); err != nil {
+    return nil, err
+  }
+  return keys, nil
+}
+// adds the given key in a transaction, unless a key of the same id
+// is held. returns false if so.
+func (repository AppEngineRepository) AddKey(key Key) (bool, error) {
+  var id = datastore.NewKey(repository.context, "KEY", strconv.FormatInt(key.Id, 10), 0, nil)
+  var added = false
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var held Key
+    added = false
+    if err := datastore.Get(context, id, &held); err == nil {
+      return nil
+    } else if err != datastore.ErrNoSuchEntity {
+      return err
+    } else if _, err := datastore.Put(context, id, &key); err != nil {
+      return err
+    } else {
+      added = true
+      return nil
+    }
+  }, nil)
+  return added, err
+}
+func (repository AppEngineRepository) DeleteKey(id int64) (error) {
+  var key = datastore.NewKey(repository.context, "KEY", strconv.FormatInt(id, 10), 0, nil)
+  return datastore.Delete(repository.context, key)
+}
+
+// puts the given nonce in a transaction, unless a nonce of the 
+// same value expires after now. returns false if so. A bounded 
+// number of expired nonces are pruned on each put.
+func (repository AppEngineRepository) PutNonce(nonce Nonce, now time.Time) (bool, error) {
+  var query = datastore.NewQuery("NONCE").Filter("Expires <", now).Limit(16).KeysOnly()
+  if keys, err := query.GetAll(repository.context, nil); err != nil {
+    return false, err
+  } else if err := datastore.DeleteMulti(repository.context, keys); err != nil {
+    return false, err
+  }
+  var key = datastore.NewKey(repository.context, "NONCE", nonce.Value, 0, nil)
+  var put = false
+  err := datastore.RunInTransaction(repository.context, func(context appengine.Context) error {
+    var held Nonce
+    put = false
+    if err := datastore.Get(context, key, &held); err == nil && !held.Expires.Before(now) {
+      return nil
+    } else if err != nil && err != datastore.ErrNoSuchEntity {
+      return err
+    }
+    put = true
+    _, err := datastore.Put(context, key, &nonce)
+    return err
+  }, nil)
+  return put && err == nil, err
+}
+
+// puts the given revocation. A bounded number of expired 
+// revocations are pruned on each put.
+func (repository AppEngineRepository) PutRevocation(revocation Revocation, now time.Time) (error) {
+  var query = datastore.NewQuery("REVOCATION").Filter("Expires <", now).Limit(16).KeysOnly()
+  if keys, err := query.GetAll(repository.context, nil); err != nil {
+    return err
+  } else if err := datastore.DeleteMulti(repository.context, keys); err != nil {
+    return err
+  }
+  var key = datastore.NewKey(repository.context, "REVOCATION", revocation.Address, 0, nil)
+  _, err := datastore.Put(repository.context, key, &revocation)
+  return err
+}
+func (repository AppEngineRepository) GetRevocation(address string) (Revocation, error) {
+  var key = datastore.NewKey(repository.context, "REVOCATION", address, 0, nil)
+  var revocation Revocation
+  if err := datastore.Get(repository.context, key, &revocation); err == datastore.ErrNoSuchEntity {
+    return revocation, ErrNoSuchRevocation
+  } else {
+    return revocation, err
+  }
+}
+
+// creates a new appengine datastore backed store.
+func NewAppEngineRepository(context appengine.Context) * AppEngineRepository {
+  var store = new(AppEngineRepository)
+  store.context = context
+  return store
+}
\ No newline at end of file
@@ -0,0 +1,498 @@
+// +build !appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "sync"
+import "time"
+import "strconv"
+import "encoding/json"
+import "encoding/binary"
+import "encoding/base64"
+import bolt "go.etcd.io/bbolt"
+
+// the key of the single DHCP and SECRET records.
+var boltRecordKey = []byte("0")
+
+// embedded key/value file repository, for durable single node
+// deployments. Records are stored as json in DHCP, SECRET, LEASE,
+// CLAIM, KEY, NONCE and REVOCATION buckets, mirroring the datastore
+// kinds, and each write is fsync'd to the file before it returns. 
+// Leases, nonces and revocations are indexed by expiry in the 
+// LEASE_EXPIRES, NONCE_EXPIRES and REVOCATION_EXPIRES buckets.
+type BoltRepository struct {
+  db     *bolt.DB
+  mutex  sync.Mutex
+  secret []byte
+}
+
+// reads the json record in the given bucket into record. returns
+// false if the record does not exist.
+func boltGet(tx *bolt.Tx, bucket string, record interface{}) (bool, error) {
+  if value := tx.Bucket([]byte(bucket)).Get(boltRecordKey); value == nil {
+    return false, nil
+  } else {
+    return true, json.Unmarshal(value, record)
+  }
+}
+
+// returns the key of a expiry index entry for the record with the
+// given key, expiring at the given time. Index keys are the big 
+// endian expiry in unix nanoseconds followed by the record key, so
+// a cursor reads the index in order of expiry.
+func boltExpiryKey(expires time.Time, record string) []byte {
+  key := make([]byte, 8, 8 + len(record))
+  if !expires.IsZero() {
+    binary.BigEndian.PutUint64(key, uint64(expires.UnixNano()))
+  }
+  return append(key, record...)
+}
+func boltExpiryTime(key []byte) time.Time {
+  if nanos := binary.BigEndian.Uint64(key[:8]); nanos != 0 {
+    return time.Unix(0, int64(nanos))
+  }
+  return time.Time {}
+}
+func boltExpiryRecord(key []byte) []byte {
+  return key[8:]
+}
+
+// writes the given lease, indexing it by expiry in LEASE_EXPIRES,
+// and dropping the index entry of the lease it replaces.
+func boltPutLease(tx *bolt.Tx, lease Lease) error {
+  leases, index := tx.Bucket([]byte("LEASE")), tx.Bucket([]byte("LEASE_EXPIRES"))
+  if value := leases.Get([]byte(lease.Address)); value != nil {
+    var held Lease
+    if err := json.Unmarshal(value, &held); err != nil {
+      return err
+    } else if err := index.Delete(boltExpiryKey(held.Expires, held.Address)); err != nil {
+      return err
+    }
+  }
+  if value, err := json.Marshal(&lease); err != nil {
+    return err
+  } else if err := leases.Put([]byte(lease.Address), value); err != nil {
+    return err
+  }
+  return index.Put(boltExpiryKey(lease.Expires, lease.Address), []byte {})
+}
+
+// deletes the records of the given bucket expired before now, 
+// reading the given expiry index from the front.
+func boltPrune(tx *bolt.Tx, bucket string, index string, now time.Time) error {
+  records, cursor := tx.Bucket([]byte(bucket)), tx.Bucket([]byte(index)).Cursor()
+  for key, _ := cursor.First(); key != nil && boltExpiryTime(key).Before(now); key, _ = cursor.First() {
+    if err := records.Delete(boltExpiryRecord(key)); err != nil {
+      return err
+    } else if err := cursor.Delete(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// indexes the records of the given bucket by expiry in the given
+// index, for files written before the index was added. Records of
+// each indexed bucket hold their expiry as Expires.
+func boltIndex(tx *bolt.Tx, bucket string, index string) error {
+  entries := tx.Bucket([]byte(index))
+  return tx.Bucket([]byte(bucket)).ForEach(func(key []byte, value []byte) error {
+    var record struct { Expires time.Time }
+    if err := json.Unmarshal(value, &record); err != nil {
+      return err
+    }
+    return entries.Put(boltExpiryKey(record.Expires, string(key)), []byte {})
+  })
+}
+
+// writes the given record as json in the given bucket.
+func boltPut(tx *bolt.Tx, bucket string, record interface{}) error {
+  if value, err := json.Marshal(record); err != nil {
+    return err
+  } else {
+    return tx.Bucket([]byte(bucket)).Put(boltRecordKey, value)
+  }
+}
+
+func (repository *BoltRepository) GetDhcpOrdinal() (int64, error) {
+  var record = new(DHCP)
+  err := repository.db.View(func(tx *bolt.Tx) error {
+    _, err := boltGet(tx, "DHCP", record)
+    return err
+  })
+  return record.Ordinal, err
+}
+func (repository *BoltRepository) SetDhcpOrdinal(ordinal int64) (error) {
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    return boltPut(tx, "DHCP", &DHCP { Ordinal: ordinal })
+  })
+}
+// increments the ordinal in a single write transaction, returns 
+// the ordinal prior to the increment.
+func (repository *BoltRepository) NextOrdinal() (int64, error) {
+  return repository.LeaseOrdinals(1)
+}
+// advances the ordinal by count in a single write transaction,
+// returns the first ordinal of the leased block.
+func (repository *BoltRepository) LeaseOrdinals(count int64) (int64, error) {
+  var record = new(DHCP)
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    if _, err := boltGet(tx, "DHCP", record); err != nil {
+      return err
+    }
+    record.Ordinal += count
+    return boltPut(tx, "DHCP", record)
+  })
+  if err != nil {
+    return 0, err
+  }
+  return record.Ordinal - count, nil
+}
+// gets the aes secret key. If the key does not exist, this 
+// function will create with a random key.
+func (repository *BoltRepository) GetSecretKey() ([]byte, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if repository.secret != nil {
+    return repository.secret, nil
+  }
+  var secret []byte
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    var record = new(SECRET)
+    if ok, err := boltGet(tx, "SECRET", record); err != nil {
+      return err
+    } else if ok {
+      secret, err = base64.URLEncoding.DecodeString(record.Value)
+      return err
+    } else {
+      if secret, err = GenerateRandomBytes(32); err != nil {
+        return err
+      }
+      record.Value = base64.URLEncoding.EncodeToString(secret)
+      return boltPut(tx, "SECRET", record)
+    }
+  })
+  if err != nil {
+    return nil, err
+  }
+  repository.secret = secret
+  return secret, nil
+}
+
+func (repository *BoltRepository) PutLease(lease Lease) (error) {
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    return boltPutLease(tx, lease)
+  })
+}
+func (repository *BoltRepository) GetLease(address string) (Lease, error) {
+  var lease Lease
+  err := repository.db.View(func(tx *bolt.Tx) error {
+    if value := tx.Bucket([]byte("LEASE")).Get([]byte(address)); value == nil {
+      return ErrNoSuchLease
+    } else {
+      return json.Unmarshal(value, &lease)
+    }
+  })
+  return lease, err
+}
+// removes and returns a lease that expired before now, taken
+// from the front of the LEASE_EXPIRES index.
+func (repository *BoltRepository) ReclaimLease(now time.Time) (Lease, bool, error) {
+  var lease Lease
+  var found = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    leases, index := tx.Bucket([]byte("LEASE")), tx.Bucket([]byte("LEASE_EXPIRES"))
+    for {
+      key, _ := index.Cursor().First()
+      if key == nil || !boltExpiryTime(key).Before(now) {
+        return nil
+      }
+      if err := index.Delete(key); err != nil {
+        return err
+      }
+      address := boltExpiryRecord(key)
+      if value := leases.Get(address); value == nil {
+        continue
+      } else if err := json.Unmarshal(value, &lease); err != nil {
+        return err
+      } else if lease.Expires.Before(now) {
+        found = true
+        return leases.Delete(address)
+      } else if err := index.Put(boltExpiryKey(lease.Expires, lease.Address), []byte {}); err != nil {
+        return err
+      }
+    }
+  })
+  if err != nil || !found {
+    return Lease {}, false, err
+  }
+  return lease, true, nil
+}
+// replaces the lease on the address of the given lease, if the 
+// lease held was created at the same time, and is not released.
+// returns false if not.
+func (repository *BoltRepository) UpdateLease(lease Lease) (bool, error) {
+  var updated = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    var held Lease
+    if value := tx.Bucket([]byte("LEASE")).Get([]byte(lease.Address)); value == nil {
+      return nil
+    } else if err := json.Unmarshal(value, &held); err != nil {
+      return err
+    } else if !held.Created.Equal(lease.Created) || !held.Released.IsZero() {
+      return nil
+    }
+    updated = true
+    return boltPutLease(tx, lease)
+  })
+  return updated && err == nil, err
+}
+// writes the given lease, if no lease is held on its address. 
+// returns false if one is.
+func (repository *BoltRepository) CreateLease(lease Lease) (bool, error) {
+  var created = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    if value := tx.Bucket([]byte("LEASE")).Get([]byte(lease.Address)); value != nil {
+      return nil
+    }
+    created = true
+    return boltPutLease(tx, lease)
+  })
+  return created && err == nil, err
+}
+// writes the given lease, if no lease is held on its address, or
+// the lease held was released, or last seen at or before stale. 
+// returns false if not.
+func (repository *BoltRepository) AcquireLease(lease Lease, stale time.Time) (bool, error) {
+  var acquired = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    var held Lease
+    if value := tx.Bucket([]byte("LEASE")).Get([]byte(lease.Address)); value != nil {
+      if err := json.Unmarshal(value, &held); err != nil {
+        return err
+      } else if held.Released.IsZero() && held.LastSeen.After(stale) {
+        return nil
+      }
+    }
+    acquired = true
+    return boltPutLease(tx, lease)
+  })
+  return acquired && err == nil, err
+}
+
+func (repository *BoltRepository) PutClaim(claim Claim) (error) {
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    if value, err := json.Marshal(&claim); err != nil {
+      return err
+    } else {
+      return tx.Bucket([]byte("CLAIM")).Put([]byte(claim.Address), value)
+    }
+  })
+}
+func (repository *BoltRepository) GetClaim(address string) (Claim, error) {
+  var claim Claim
+  err := repository.db.View(func(tx *bolt.Tx) error {
+    if value := tx.Bucket([]byte("CLAIM")).Get([]byte(address)); value == nil {
+      return ErrNoSuchClaim
+    } else {
+      return json.Unmarshal(value, &claim)
+    }
+  })
+  return claim, err
+}
+
+func (repository *BoltRepository) GetKeys() ([]Key, error) {
+  var keys []Key
+  err := repository.db.View(func(tx *bolt.Tx) error {
+    return tx.Bucket([]byte("KEY")).ForEach(func(id []byte, value []byte) error {
+      var key Key
+      if err := json.Unmarshal(value, &key); err != nil {
+        return err
+      }
+      keys = append(keys, key)
+      return nil
+    })
+  })
+  return keys, err
+}
+// adds the given key, unless a key of the same id is held. returns
+// false if so.
+func (repository *BoltRepository) AddKey(key Key) (bool, error) {
+  var added = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("KEY"))
+    if bucket.Get([]byte(strconv.FormatInt(key.Id, 10))) != nil {
+      return nil
+    } else if value, err := json.Marshal(&key); err != nil {
+      return err
+    } else {
+      added = true
+      return bucket.Put([]byte(strconv.FormatInt(key.Id, 10)), value)
+    }
+  })
+  return added, err
+}
+func (repository *BoltRepository) DeleteKey(id int64) (error) {
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    return tx.Bucket([]byte("KEY")).Delete([]byte(strconv.FormatInt(id, 10)))
+  })
+}
+
+// puts the given nonce, unless a nonce of the same value expires 
+// after now. returns false if so. Nonces expired before now are 
+// pruned from the front of NONCE_EXPIRES.
+func (repository *BoltRepository) PutNonce(nonce Nonce, now time.Time) (bool, error) {
+  var put = false
+  err := repository.db.Update(func(tx *bolt.Tx) error {
+    if err := boltPrune(tx, "NONCE", "NONCE_EXPIRES", now); err != nil {
+      return err
+    } else if tx.Bucket([]byte("NONCE")).Get([]byte(nonce.Value)) != nil {
+      return nil
+    } else if value, err := json.Marshal(&nonce); err != nil {
+      return err
+    } else if err := tx.Bucket([]byte("NONCE")).Put([]byte(nonce.Value), value); err != nil {
+      return err
+    } else {
+      put = true
+      return tx.Bucket([]byte("NONCE_EXPIRES")).Put(boltExpiryKey(nonce.Expires, nonce.Value), []byte {})
+    }
+  })
+  return put && err == nil, err
+}
+
+// puts the given revocation, replacing any held for the address.
+// Revocations expired before now are pruned from the front of 
+// REVOCATION_EXPIRES.
+func (repository *BoltRepository) PutRevocation(revocation Revocation, now time.Time) (error) {
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    bucket, index := tx.Bucket([]byte("REVOCATION")), tx.Bucket([]byte("REVOCATION_EXPIRES"))
+    if err := boltPrune(tx, "REVOCATION", "REVOCATION_EXPIRES", now); err != nil {
+      return err
+    }
+    if value := bucket.Get([]byte(revocation.Address)); value != nil {
+      var held Revocation
+      if err := json.Unmarshal(value, &held); err != nil {
+        return err
+      } else if err := index.Delete(boltExpiryKey(held.Expires, held.Address)); err != nil {
+        return err
+      }
+    }
+    if value, err := json.Marshal(&revocation); err != nil {
+      return err
+    } else if err := bucket.Put([]byte(revocation.Address), value); err != nil {
+      return err
+    } else {
+      return index.Put(boltExpiryKey(revocation.Expires, revocation.Address), []byte {})
+    }
+  })
+}
+func (repository *BoltRepository) GetRevocation(address string) (Revocation, error) {
+  var revocation Revocation
+  err := repository.db.View(func(tx *bolt.Tx) error {
+    if value := tx.Bucket([]byte("REVOCATION")).Get([]byte(address)); value == nil {
+      return ErrNoSuchRevocation
+    } else {
+      return json.Unmarshal(value, &revocation)
+    }
+  })
+  return revocation, err
+}
+
+// imports the records of the given export, replacing the 
+// records held in this repository.
+func (repository *BoltRepository) Import(export Export) error {
+  if _, err := base64.URLEncoding.DecodeString(export.SECRET.Value); err != nil {
+    return err
+  }
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.secret = nil
+  return repository.db.Update(func(tx *bolt.Tx) error {
+    if err := boltPut(tx, "DHCP", &export.DHCP); err != nil {
+      return err
+    } else if err := boltPut(tx, "SECRET", &export.SECRET); err != nil {
+      return err
+    } else if err := tx.DeleteBucket([]byte("KEY")); err != nil {
+      return err
+    } else if bucket, err := tx.CreateBucket([]byte("KEY")); err != nil {
+      return err
+    } else {
+      for _, key := range export.KEY {
+        if value, err := json.Marshal(&key); err != nil {
+          return err
+        } else if err := bucket.Put([]byte(strconv.FormatInt(key.Id, 10)), value); err != nil {
+          return err
+        }
+      }
+      return nil
+    }
+  })
+}
+
+// closes the underlying file.
+func (repository *BoltRepository) Close() error {
+  return repository.db.Close()
+}
+
+// creates a new repository backed by the file at the given path, 
+// creating the file if it does not exist.
+func NewBoltRepository(path string) (* BoltRepository, error) {
+  db, err := bolt.Open(path, 0600, &bolt.Options { Timeout: 5 * time.Second })
+  if err != nil {
+    return nil, err
+  }
+  err = db.Update(func(tx *bolt.Tx) error {
+    indexes := map[string]string { "LEASE": "LEASE_EXPIRES", "NONCE": "NONCE_EXPIRES", "REVOCATION": "REVOCATION_EXPIRES" }
+    var unindexed []string
+    for bucket, index := range indexes {
+      if tx.Bucket([]byte(index)) == nil {
+        unindexed = append(unindexed, bucket)
+      }
+    }
+    for _, bucket := range []string { "DHCP", "SECRET", "LEASE", "LEASE_EXPIRES", "CLAIM", "KEY", "NONCE", "NONCE_EXPIRES", "REVOCATION", "REVOCATION_EXPIRES" } {
+      if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+        return err
+      }
+    }
+    for _, bucket := range unindexed {
+      if err := boltIndex(tx, bucket, indexes[bucket]); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
+  var repository = new(BoltRepository)
+  repository.db = db
+  return repository, nil
+}
@@ -0,0 +1,77 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "time"
+import "container/heap"
+
+// a key of a record, and the time the record expires.
+type expiry struct {
+  key     string
+  expires time.Time
+}
+
+// queue of record keys ordered by expiry, for the in memory
+// repository to find expired records without scanning them all.
+// Entries are not removed when a record changes, so entries taken
+// from the queue are checked against the record they name.
+type expiryQueue []expiry
+
+func (queue expiryQueue) Len() int {
+  return len(queue)
+}
+func (queue expiryQueue) Less(i, j int) bool {
+  return queue[i].expires.Before(queue[j].expires)
+}
+func (queue expiryQueue) Swap(i, j int) {
+  queue[i], queue[j] = queue[j], queue[i]
+}
+func (queue *expiryQueue) Push(value interface{}) {
+  *queue = append(*queue, value.(expiry))
+}
+func (queue *expiryQueue) Pop() interface{} {
+  old   := *queue
+  entry := old[len(old) - 1]
+  *queue = old[:len(old) - 1]
+  return entry
+}
+
+// adds the given key, expiring at the given time.
+func (queue *expiryQueue) add(key string, expires time.Time) {
+  heap.Push(queue, expiry { key: key, expires: expires })
+}
+
+// removes and returns the entry expiring first, if it expired
+// before now.
+func (queue *expiryQueue) expired(now time.Time) (expiry, bool) {
+  if queue.Len() == 0 || !(*queue)[0].expires.Before(now) {
+    return expiry {}, false
+  }
+  return heap.Pop(queue).(expiry), true
+}
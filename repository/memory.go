@@ -0,0 +1,249 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "sync"
+import "time"
+
+// in memory repository, for single node deployments and
+// testing. state is held for the life of the process, and
+// is safe for use by many goroutines at once.
+type MemoryRepository struct {
+  mutex   sync.Mutex
+  ordinal int64
+  secret  []byte
+  leases  map[string]Lease
+  expires expiryQueue
+  claims  map[string]Claim
+  keys    map[int64]Key
+  nonces  map[string]Nonce
+  revoked map[string]Revocation
+  nonceExpires   expiryQueue
+  revokedExpires expiryQueue
+}
+func (repository *MemoryRepository) GetDhcpOrdinal() (int64, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  return repository.ordinal, nil
+}
+func (repository *MemoryRepository) SetDhcpOrdinal(ordinal int64) (error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.ordinal = ordinal
+  return nil
+}
+// increments the ordinal, returns the ordinal prior to the increment.
+func (repository *MemoryRepository) NextOrdinal() (int64, error) {
+  return repository.LeaseOrdinals(1)
+}
+// advances the ordinal by count, returns the first ordinal of
+// the leased block.
+func (repository *MemoryRepository) LeaseOrdinals(count int64) (int64, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.ordinal += count
+  return repository.ordinal - count, nil
+}
+// gets the aes secret key. If the key does not exist, this 
+// function will create with a random key.
+func (repository *MemoryRepository) GetSecretKey() ([]byte, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if repository.secret == nil {
+    if bytes, err := GenerateRandomBytes(32); err != nil {
+      return nil, err
+    } else {
+      repository.secret = bytes
+    }
+  }
+  return repository.secret, nil
+}
+
+func (repository *MemoryRepository) PutLease(lease Lease) (error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.leases[lease.Address] = lease
+  repository.expires.add(lease.Address, lease.Expires)
+  return nil
+}
+func (repository *MemoryRepository) GetLease(address string) (Lease, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if lease, ok := repository.leases[address]; !ok {
+    return lease, ErrNoSuchLease
+  } else {
+    return lease, nil
+  }
+}
+// removes and returns a lease that expired before now.
+func (repository *MemoryRepository) ReclaimLease(now time.Time) (Lease, bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  for {
+    if entry, ok := repository.expires.expired(now); !ok {
+      return Lease {}, false, nil
+    } else if lease, ok := repository.leases[entry.key]; ok && lease.Expires.Equal(entry.expires) {
+      delete(repository.leases, entry.key)
+      return lease, true, nil
+    }
+  }
+}
+// replaces the lease on the address of the given lease, if the 
+// lease held was created at the same time, and is not released.
+// returns false if not.
+func (repository *MemoryRepository) UpdateLease(lease Lease) (bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if held, ok := repository.leases[lease.Address]; !ok || !held.Created.Equal(lease.Created) || !held.Released.IsZero() {
+    return false, nil
+  }
+  repository.leases[lease.Address] = lease
+  repository.expires.add(lease.Address, lease.Expires)
+  return true, nil
+}
+// writes the given lease, if no lease is held on its address. 
+// returns false if one is.
+func (repository *MemoryRepository) CreateLease(lease Lease) (bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if _, ok := repository.leases[lease.Address]; ok {
+    return false, nil
+  }
+  repository.leases[lease.Address] = lease
+  repository.expires.add(lease.Address, lease.Expires)
+  return true, nil
+}
+// writes the given lease, if no lease is held on its address, or
+// the lease held was released, or last seen at or before stale. 
+// returns false if not.
+func (repository *MemoryRepository) AcquireLease(lease Lease, stale time.Time) (bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if held, ok := repository.leases[lease.Address]; ok && held.Released.IsZero() && held.LastSeen.After(stale) {
+    return false, nil
+  }
+  repository.leases[lease.Address] = lease
+  repository.expires.add(lease.Address, lease.Expires)
+  return true, nil
+}
+
+func (repository *MemoryRepository) PutClaim(claim Claim) (error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.claims[claim.Address] = claim
+  return nil
+}
+func (repository *MemoryRepository) GetClaim(address string) (Claim, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if claim, ok := repository.claims[address]; !ok {
+    return claim, ErrNoSuchClaim
+  } else {
+    return claim, nil
+  }
+}
+
+func (repository *MemoryRepository) GetKeys() ([]Key, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  var keys []Key
+  for _, key := range repository.keys {
+    keys = append(keys, key)
+  }
+  return keys, nil
+}
+// adds the given key, unless a key of the same id is held. returns
+// false if so.
+func (repository *MemoryRepository) AddKey(key Key) (bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if _, ok := repository.keys[key.Id]; ok {
+    return false, nil
+  }
+  repository.keys[key.Id] = key
+  return true, nil
+}
+func (repository *MemoryRepository) DeleteKey(id int64) (error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  delete(repository.keys, id)
+  return nil
+}
+
+// puts the given nonce, unless a nonce of the same value expires 
+// after now. returns false if so. Nonces expired before now are 
+// pruned in order of expiry.
+func (repository *MemoryRepository) PutNonce(nonce Nonce, now time.Time) (bool, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  for entry, ok := repository.nonceExpires.expired(now); ok; entry, ok = repository.nonceExpires.expired(now) {
+    if held, ok := repository.nonces[entry.key]; ok && held.Expires.Equal(entry.expires) {
+      delete(repository.nonces, entry.key)
+    }
+  }
+  if _, ok := repository.nonces[nonce.Value]; ok {
+    return false, nil
+  }
+  repository.nonces[nonce.Value] = nonce
+  repository.nonceExpires.add(nonce.Value, nonce.Expires)
+  return true, nil
+}
+
+func (repository *MemoryRepository) PutRevocation(revocation Revocation, now time.Time) (error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  for entry, ok := repository.revokedExpires.expired(now); ok; entry, ok = repository.revokedExpires.expired(now) {
+    if held, ok := repository.revoked[entry.key]; ok && held.Expires.Equal(entry.expires) {
+      delete(repository.revoked, entry.key)
+    }
+  }
+  repository.revoked[revocation.Address] = revocation
+  repository.revokedExpires.add(revocation.Address, revocation.Expires)
+  return nil
+}
+func (repository *MemoryRepository) GetRevocation(address string) (Revocation, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if revocation, ok := repository.revoked[address]; !ok {
+    return revocation, ErrNoSuchRevocation
+  } else {
+    return revocation, nil
+  }
+}
+
+// creates a new in memory repository.
+func NewMemoryRepository() * MemoryRepository {
+  var repository = new(MemoryRepository)
+  repository.leases  = make(map[string]Lease)
+  repository.claims  = make(map[string]Claim)
+  repository.keys    = make(map[int64]Key)
+  repository.nonces  = make(map[string]Nonce)
+  repository.revoked = make(map[string]Revocation)
+  return repository
+}
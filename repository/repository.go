@@ -28,34 +28,41 @@
 
 package repository
 
-import "appengine"
-import "appengine/datastore"
-import "encoding/base64"
+import "time"
+import "errors"
 import "crypto/rand"
-
+import "encoding/base64"
 
 type Repository interface {
-    GetDhcpOrdinal ()              (int64, error)
-    SetDhcpOrdinal (ordinal int64) (error)
-    GetSecretKey   ()              ([]byte, error)
+    GetDhcpOrdinal ()               (int64, error)
+    SetDhcpOrdinal (ordinal int64)  (error)
+    NextOrdinal    ()               (int64, error)
+    LeaseOrdinals  (count int64)    (int64, error)
+    GetSecretKey   ()               ([]byte, error)
+    PutLease       (lease Lease)    (error)
+    GetLease       (address string) (Lease, error)
+    ReclaimLease   (now time.Time)  (Lease, bool, error)
+    UpdateLease    (lease Lease)    (bool, error)
+    CreateLease    (lease Lease)    (bool, error)
+    AcquireLease   (lease Lease, stale time.Time) (bool, error)
+    PutClaim       (claim Claim)    (error)
+    GetClaim       (address string) (Claim, error)
+    GetKeys        ()               ([]Key, error)
+    AddKey         (key Key)        (bool, error)
+    DeleteKey      (id int64)       (error)
+    PutNonce       (nonce Nonce, now time.Time) (bool, error)
+    PutRevocation  (revocation Revocation, now time.Time) (error)
+    GetRevocation  (address string) (Revocation, error)
 }
 
-//-----------------------------------------------------
-// helper for creating keys on demand
-//-----------------------------------------------------
-func GenerateRandomBytes(length int) ([]byte, error) {
-    b := make([]byte, length)
-    _, err := rand.Read(b)
-    if err != nil {
-        return nil, err
-    }
-    return b, nil
-}
+// returned when getting a lease that does not exist.
+var ErrNoSuchLease = errors.New("no such lease.")
 
-//-----------------------------------------------------
-// internally cached secret key. 
-//-----------------------------------------------------
-var CACHED_SECRET_KEY []byte = nil
+// returned when getting a claim that does not exist.
+var ErrNoSuchClaim = errors.New("no such claim.")
+
+// returned when getting a revocation that does not exist.
+var ErrNoSuchRevocation = errors.New("no such revocation.")
 
 // DHCP datastore record.
 type DHCP struct {
@@ -67,61 +74,95 @@ type SECRET struct {
   Value string
 }
 
-type AppEngineRepository struct {
-  context appengine.Context
+// LEASE datastore record. Tracks a allocated address, keyed by
+// address. The address may be reclaimed for reuse once expires
+// has passed, which allocators set past the lease timeout on
+// renewal, and past the quarantine period on release. Claimed
+// leases hold a reserved address, and are not reused once expired.
+// Key holds the base64 public key of the client, if it has one.
+type Lease struct {
+  Address  string
+  Created  time.Time
+  LastSeen time.Time
+  Released time.Time
+  Expires  time.Time
+  Claimed  bool
+  Key      string
 }
-func (repository AppEngineRepository) GetDhcpOrdinal() (int64, error) {
-  var key = datastore.NewKey(repository.context, "DHCP", "0", 0, nil)
-  var record = new(DHCP)
-  var err = datastore.Get(repository.context, key, record)
-  if err != nil {
-    record.Ordinal = 0  
-  }
-  return record.Ordinal, nil
+
+// CLAIM datastore record. Grants the holder of a secret the reserved
+// address, keyed by address. Secret holds the base64 sha256 hash of
+// the secret, so the secret itself is never stored.
+type Claim struct {
+  Address  string
+  Secret   string
+  Created  time.Time
+}
+
+// KEY datastore record. A key of the identity key ring, keyed by
+// id. Value holds the base64 key. Key 0 is a copy of the SECRET.
+// Keys are added only if no key of the same id is held, so a key 
+// sealing tokens is never replaced.
+type Key struct {
+  Id       int64
+  Value    string
+  Created  time.Time
+}
+
+// NONCE datastore record. A nonce seen on a request, keyed by value,
+// and held until expires so requests replaying it are rejected. 
+// Nonces are put only if no unexpired nonce of the same value is 
+// held, and expired nonces are pruned as nonces are put.
+type Nonce struct {
+  Value    string
+  Expires  time.Time
+}
+
+// REVOCATION datastore record. Revokes the identities issued for a
+// address up to revoked, keyed by address. Held until expires, when
+// the revoked identities have expired, and expired revocations are 
+// pruned as revocations are put.
+type Revocation struct {
+  Address  string
+  Revoked  time.Time
+  Expires  time.Time
 }
-func (repository AppEngineRepository) SetDhcpOrdinal(ordinal int64) (error) {
-  var key = datastore.NewKey(repository.context, "DHCP", "0", 0, nil)
-  var record = new(DHCP)
-  record.Ordinal = ordinal
-  if _, err := datastore.Put(repository.context, key, record); err != nil {
-    return err  
+
+// a portable snapshot of the repository records, written by the 
+// appengine /admin/export handler and read by offline imports.
+type Export struct {
+  DHCP   DHCP
+  SECRET SECRET
+  KEY    []Key
+}
+
+// exports the records of the given repository.
+func ExportRepository(repository Repository) (Export, error) {
+  var export Export
+  if ordinal, err := repository.GetDhcpOrdinal(); err != nil {
+    return export, err
+  } else {
+    if key, err := repository.GetSecretKey(); err != nil {
+      return export, err
+    } else if keys, err := repository.GetKeys(); err != nil {
+      return export, err
+    } else {
+      export.DHCP.Ordinal = ordinal
+      export.SECRET.Value = base64.URLEncoding.EncodeToString(key)
+      export.KEY          = keys
+      return export, nil
+    }
   }
-  return nil
 }
-// gets the aes secret key. If the key does not exist, this 
-// function will create with a random key.
-func (repository AppEngineRepository) GetSecretKey() ([]byte, error) {
-  // check the cache for the key.
-	if CACHED_SECRET_KEY != nil {
-		return CACHED_SECRET_KEY, nil
-	}
-	var key    = datastore.NewKey(repository.context, "SECRET", "0", 0, nil)
-	var record = new(SECRET)
-	if err := datastore.Get(repository.context, key, record); err != nil {
-    if bytes, err := GenerateRandomBytes(32); err != nil {
-			return nil, err
-		} else {
-      record.Value = base64.URLEncoding.EncodeToString(bytes)
-      if _, err := datastore.Put(repository.context, key, record); err != nil {
+
+//-----------------------------------------------------
+// helper for creating keys on demand
+//-----------------------------------------------------
+func GenerateRandomBytes(length int) ([]byte, error) {
+    b := make([]byte, length)
+    _, err := rand.Read(b)
+    if err != nil {
         return nil, err
-      } else {
-        CACHED_SECRET_KEY = bytes
-        return CACHED_SECRET_KEY, nil
-      }
-    }
-	} else {
-		if bytes, err := base64.URLEncoding.DecodeString(record.Value); err != nil {
-			return nil, err 
-		} else {
-      CACHED_SECRET_KEY = bytes
-      return CACHED_SECRET_KEY, nil
     }
-	}
+    return b, nil
 }
-
-// creates a new appengine datastore backed store.
-func NewAppEngineRepository(context appengine.Context) * AppEngineRepository {
-  var store = new(AppEngineRepository)
-  store.context = context
-  return store
-}
\ No newline at end of file
@@ -0,0 +1,253 @@
+// +build !appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "time"
+import "sync"
+import "testing"
+import "sync/atomic"
+import "path/filepath"
+
+// returns a empty repository of each standalone backend.
+func backends(t *testing.T) map[string]Repository {
+  store, err := NewBoltRepository(filepath.Join(t.TempDir(), "hub.bolt"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { store.Close() })
+  return map[string]Repository {
+    "memory" : NewMemoryRepository(),
+    "bolt"   : store,
+    "sqlite" : openSqlite(t, filepath.Join(t.TempDir(), "hub.db")),
+  }
+}
+
+func TestReclaimLease(t *testing.T) {
+  for name, store := range backends(t) {
+    now := time.Now()
+    for address, expires := range map[string]time.Duration { "a": -1 * time.Minute, "b": -2 * time.Minute, "c": time.Minute, "d": -3 * time.Minute } {
+      if err := store.PutLease(Lease { Address: address, Created: now, Expires: now.Add(expires) }); err != nil {
+        t.Fatal(name, err)
+      }
+    }
+    // renewing d leaves a stale index entry, which is skipped.
+    if err := store.PutLease(Lease { Address: "d", Created: now, Expires: now.Add(time.Hour) }); err != nil {
+      t.Fatal(name, err)
+    }
+    for _, expected := range []string { "b", "a" } {
+      if lease, ok, err := store.ReclaimLease(now); err != nil || !ok || lease.Address != expected {
+        t.Fatalf("%s: expected %s, got %v %v %v", name, expected, lease.Address, ok, err)
+      }
+    }
+    if lease, ok, err := store.ReclaimLease(now); err != nil || ok {
+      t.Fatalf("%s: expected no lease, got %v %v", name, lease.Address, err)
+    }
+  }
+}
+
+func TestUpdateLease(t *testing.T) {
+  for name, store := range backends(t) {
+    now   := time.Now()
+    lease := Lease { Address: "a", Created: now, LastSeen: now, Expires: now.Add(time.Hour) }
+    if err := store.PutLease(lease); err != nil {
+      t.Fatal(name, err)
+    }
+    renewed := lease
+    renewed.LastSeen = now.Add(time.Minute)
+    released := lease
+    released.Released = now
+    if lease, err := store.GetLease("a"); err != nil {
+      t.Fatal(name, err)
+    } else if ok, err := store.UpdateLease(released); err != nil || !ok {
+      t.Fatalf("%s: expected release of %v, got %v %v", name, lease, ok, err)
+    } else if ok, err := store.UpdateLease(renewed); err != nil || ok {
+      t.Fatalf("%s: expected released lease not renewed, got %v %v", name, ok, err)
+    } else if lease, err := store.GetLease("a"); err != nil || lease.Released.IsZero() {
+      t.Fatalf("%s: expected lease released, got %v %v", name, lease, err)
+    }
+    if err := store.PutLease(Lease { Address: "a", Created: now.Add(time.Second), Expires: now.Add(time.Hour) }); err != nil {
+      t.Fatal(name, err)
+    } else if ok, err := store.UpdateLease(renewed); err != nil || ok {
+      t.Fatalf("%s: expected lease leased again not renewed, got %v %v", name, ok, err)
+    }
+  }
+}
+
+func TestCreateLease(t *testing.T) {
+  for name, store := range backends(t) {
+    now := time.Now()
+    if ok, err := store.CreateLease(Lease { Address: "a", Created: now, Expires: now.Add(time.Hour) }); err != nil || !ok {
+      t.Fatalf("%s: expected lease created, got %v %v", name, ok, err)
+    }
+    if ok, err := store.CreateLease(Lease { Address: "a", Created: now.Add(time.Second), Expires: now.Add(time.Hour) }); err != nil || ok {
+      t.Fatalf("%s: expected lease held not replaced, got %v %v", name, ok, err)
+    }
+    if lease, err := store.GetLease("a"); err != nil || !lease.Created.Equal(now) {
+      t.Fatalf("%s: expected first lease held, got %v %v", name, lease, err)
+    }
+  }
+}
+
+func TestAcquireLease(t *testing.T) {
+  for name, store := range backends(t) {
+    now   := time.Now()
+    stale := now.Add(-time.Hour)
+    lease := Lease { Address: "a", Created: now, LastSeen: now, Expires: now.Add(time.Hour), Claimed: true }
+    if ok, err := store.AcquireLease(lease, stale); err != nil || !ok {
+      t.Fatalf("%s: expected free address acquired, got %v %v", name, ok, err)
+    }
+    if ok, err := store.AcquireLease(lease, stale); err != nil || ok {
+      t.Fatalf("%s: expected address in use not acquired, got %v %v", name, ok, err)
+    }
+    // leases released, or not seen since stale, are taken over.
+    released := lease
+    released.Released = now
+    store.PutLease(released)
+    if ok, err := store.AcquireLease(lease, stale); err != nil || !ok {
+      t.Fatalf("%s: expected released address acquired, got %v %v", name, ok, err)
+    }
+    if ok, err := store.AcquireLease(lease, now); err != nil || !ok {
+      t.Fatalf("%s: expected stale address acquired, got %v %v", name, ok, err)
+    }
+    // of callers racing to acquire a address, only one succeeds.
+    var group sync.WaitGroup
+    var count int32
+    for i := 0; i < 8; i++ {
+      group.Add(1)
+      go func() {
+        defer group.Done()
+        if ok, err := store.AcquireLease(Lease { Address: "b", Created: now, LastSeen: now, Expires: now.Add(time.Hour) }, stale); err != nil {
+          t.Error(name, err)
+        } else if ok {
+          atomic.AddInt32(&count, 1)
+        }
+      }()
+    }
+    group.Wait()
+    if count != 1 {
+      t.Fatalf("%s: expected one acquire, got %d", name, count)
+    }
+  }
+}
+
+func TestAddKey(t *testing.T) {
+  for name, store := range backends(t) {
+    key := Key { Id: 1, Value: "first", Created: time.Unix(100, 0) }
+    if added, err := store.AddKey(key); err != nil || !added {
+      t.Fatalf("%s: expected key added, got %v %v", name, added, err)
+    }
+    // a key of a id held is never replaced.
+    if added, err := store.AddKey(Key { Id: 1, Value: "second", Created: time.Unix(200, 0) }); err != nil || added {
+      t.Fatalf("%s: expected key not added, got %v %v", name, added, err)
+    }
+    if keys, err := store.GetKeys(); err != nil || len(keys) != 1 || keys[0].Value != "first" {
+      t.Fatalf("%s: expected first key held, got %v %v", name, keys, err)
+    }
+  }
+}
+
+func TestImport(t *testing.T) {
+  source := NewMemoryRepository()
+  source.SetDhcpOrdinal(42)
+  source.AddKey(Key { Id: 0, Value: "zero", Created: time.Unix(100, 0) })
+  source.AddKey(Key { Id: 1, Value: "one",  Created: time.Unix(200, 0) })
+  export, err := ExportRepository(source)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for name, store := range backends(t) {
+    importer, ok := store.(interface { Import(Export) error })
+    if !ok {
+      continue
+    }
+    store.AddKey(Key { Id: 7, Value: "stale", Created: time.Unix(300, 0) })
+    if err := importer.Import(export); err != nil {
+      t.Fatal(name, err)
+    }
+    if imported, err := ExportRepository(store); err != nil {
+      t.Fatal(name, err)
+    } else if imported.DHCP.Ordinal != 42 || imported.SECRET.Value != export.SECRET.Value || len(imported.KEY) != 2 {
+      t.Fatalf("%s: expected %v imported, got %v", name, export, imported)
+    } else {
+      for _, key := range imported.KEY {
+        if key.Id != 0 && key.Id != 1 || !key.Created.Equal(time.Unix(100 * (key.Id + 1), 0)) {
+          t.Fatalf("%s: unexpected key %v imported", name, key)
+        }
+      }
+    }
+  }
+}
+
+func TestPutNonce(t *testing.T) {
+  for name, store := range backends(t) {
+    now := time.Now()
+    for _, value := range []string { "a", "b", "c" } {
+      if put, err := store.PutNonce(Nonce { Value: value, Expires: now.Add(time.Minute) }, now); err != nil || !put {
+        t.Fatalf("%s: expected %s put, got %v %v", name, value, put, err)
+      }
+    }
+    if put, err := store.PutNonce(Nonce { Value: "b", Expires: now.Add(time.Minute) }, now); err != nil || put {
+      t.Fatalf("%s: expected held nonce rejected, got %v %v", name, put, err)
+    }
+    // nonces expired are pruned, and may be put again.
+    later := now.Add(2 * time.Minute)
+    if put, err := store.PutNonce(Nonce { Value: "b", Expires: later.Add(time.Minute) }, later); err != nil || !put {
+      t.Fatalf("%s: expected expired nonce put, got %v %v", name, put, err)
+    }
+  }
+}
+
+func TestPutRevocation(t *testing.T) {
+  for name, store := range backends(t) {
+    now := time.Now()
+    if err := store.PutRevocation(Revocation { Address: "a", Revoked: now, Expires: now.Add(time.Minute) }, now); err != nil {
+      t.Fatal(name, err)
+    }
+    // revoking again extends the revocation past its first expiry.
+    if err := store.PutRevocation(Revocation { Address: "a", Revoked: now, Expires: now.Add(time.Hour) }, now); err != nil {
+      t.Fatal(name, err)
+    }
+    if err := store.PutRevocation(Revocation { Address: "b", Revoked: now, Expires: now.Add(time.Minute) }, now.Add(2 * time.Minute)); err != nil {
+      t.Fatal(name, err)
+    }
+    if _, err := store.GetRevocation("a"); err != nil {
+      t.Fatalf("%s: expected a revoked, got %v", name, err)
+    }
+    if err := store.PutRevocation(Revocation { Address: "c", Revoked: now, Expires: now.Add(2 * time.Hour) }, now.Add(90 * time.Minute)); err != nil {
+      t.Fatal(name, err)
+    }
+    for address, expected := range map[string]error { "a": ErrNoSuchRevocation, "b": ErrNoSuchRevocation, "c": nil } {
+      if _, err := store.GetRevocation(address); err != expected {
+        t.Fatalf("%s: expected %s %v, got %v", name, address, expected, err)
+      }
+    }
+  }
+}
@@ -0,0 +1,400 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "sync"
+import "time"
+import "database/sql"
+import "encoding/base64"
+
+// schema migrations for the sql repository, applied in order.
+// the index of each migration is its schema version. migrations
+// are written to run on both sqlite and postgres.
+var sqlMigrations = []string {
+  `CREATE TABLE dhcp (id INTEGER PRIMARY KEY, ordinal BIGINT NOT NULL);
+   INSERT INTO dhcp (id, ordinal) VALUES (0, 0)`,
+  `CREATE TABLE secret (id INTEGER PRIMARY KEY, value TEXT NOT NULL)`,
+  `CREATE TABLE lease (address TEXT PRIMARY KEY, created BIGINT NOT NULL, last_seen BIGINT NOT NULL, released BIGINT NOT NULL, expires BIGINT NOT NULL);
+   CREATE INDEX lease_expires ON lease (expires)`,
+  `ALTER TABLE lease ADD COLUMN claimed INTEGER NOT NULL DEFAULT 0;
+   CREATE TABLE claim (address TEXT PRIMARY KEY, secret TEXT NOT NULL, created BIGINT NOT NULL)`,
+  `CREATE TABLE secret_key (id BIGINT PRIMARY KEY, value TEXT NOT NULL, created BIGINT NOT NULL)`,
+  `ALTER TABLE lease ADD COLUMN public_key TEXT NOT NULL DEFAULT ''`,
+  `CREATE TABLE nonce (value TEXT PRIMARY KEY, expires BIGINT NOT NULL);
+   CREATE INDEX nonce_expires ON nonce (expires)`,
+  `CREATE TABLE revocation (address TEXT PRIMARY KEY, revoked BIGINT NOT NULL, expires BIGINT NOT NULL);
+   CREATE INDEX revocation_expires ON revocation (expires)`,
+}
+
+// times are stored as unix nanoseconds, with 0 for the zero time.
+func sqlTime(value time.Time) int64 {
+  if value.IsZero() {
+    return 0
+  }
+  return value.UnixNano()
+}
+func sqlTimeValue(value int64) time.Time {
+  if value == 0 {
+    return time.Time {}
+  }
+  return time.Unix(0, value)
+}
+
+// booleans are stored as integers, 1 for true.
+func sqlBool(value bool) int64 {
+  if value {
+    return 1
+  }
+  return 0
+}
+
+// scans a lease from the given row.
+func sqlScanLease(row *sql.Row) (Lease, error) {
+  var lease Lease
+  var created, seen, released, expires, claimed int64
+  if err := row.Scan(&lease.Address, &created, &seen, &released, &expires, &claimed, &lease.Key); err != nil {
+    return lease, err
+  }
+  lease.Created  = sqlTimeValue(created)
+  lease.LastSeen = sqlTimeValue(seen)
+  lease.Released = sqlTimeValue(released)
+  lease.Expires  = sqlTimeValue(expires)
+  lease.Claimed  = claimed != 0
+  return lease, nil
+}
+
+// database/sql repository, for deployments on sqlite or 
+// postgres. The ordinal is incremented with a single atomic
+// update, so one database may be shared by many hub nodes.
+type SqlRepository struct {
+  db     *sql.DB
+  mutex  sync.Mutex
+  secret []byte
+}
+
+// applies any migrations not yet applied to the database. Each
+// version is claimed in schema_migrations before its migration is
+// run in the same transaction, so nodes starting together against
+// one database wait on the node applying a migration, then skip it.
+func (repository *SqlRepository) migrate() error {
+  if _, err := repository.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+    return err
+  }
+  for version, migration := range sqlMigrations {
+    if tx, err := repository.db.Begin(); err != nil {
+      return err
+    } else {
+      if result, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1) ON CONFLICT (version) DO NOTHING`, version); err != nil {
+        tx.Rollback()
+        return err
+      } else if claimed, err := result.RowsAffected(); err != nil {
+        tx.Rollback()
+        return err
+      } else if claimed == 0 {
+        tx.Rollback()
+        continue
+      }
+      if _, err := tx.Exec(migration); err != nil {
+        tx.Rollback()
+        return err
+      }
+      if err := tx.Commit(); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+func (repository *SqlRepository) GetDhcpOrdinal() (int64, error) {
+  var ordinal int64
+  err := repository.db.QueryRow(`SELECT ordinal FROM dhcp WHERE id = 0`).Scan(&ordinal)
+  return ordinal, err
+}
+func (repository *SqlRepository) SetDhcpOrdinal(ordinal int64) (error) {
+  _, err := repository.db.Exec(`UPDATE dhcp SET ordinal = $1 WHERE id = 0`, ordinal)
+  return err
+}
+// atomically increments the ordinal, returns the ordinal 
+// prior to the increment.
+func (repository *SqlRepository) NextOrdinal() (int64, error) {
+  return repository.LeaseOrdinals(1)
+}
+// atomically advances the ordinal by count, returns the first
+// ordinal of the leased block.
+func (repository *SqlRepository) LeaseOrdinals(count int64) (int64, error) {
+  var ordinal int64
+  err := repository.db.QueryRow(`UPDATE dhcp SET ordinal = ordinal + $1 WHERE id = 0 RETURNING ordinal - $1`, count).Scan(&ordinal)
+  return ordinal, err
+}
+// gets the aes secret key. If the key does not exist, this 
+// function will create with a random key. Where many nodes
+// race to create the key, the first key written is used.
+func (repository *SqlRepository) GetSecretKey() ([]byte, error) {
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  if repository.secret != nil {
+    return repository.secret, nil
+  }
+  if bytes, err := GenerateRandomBytes(32); err != nil {
+    return nil, err
+  } else {
+    var value = base64.URLEncoding.EncodeToString(bytes)
+    if _, err := repository.db.Exec(`INSERT INTO secret (id, value) VALUES (0, $1) ON CONFLICT (id) DO NOTHING`, value); err != nil {
+      return nil, err
+    }
+    if err := repository.db.QueryRow(`SELECT value FROM secret WHERE id = 0`).Scan(&value); err != nil {
+      return nil, err
+    }
+    if secret, err := base64.URLEncoding.DecodeString(value); err != nil {
+      return nil, err
+    } else {
+      repository.secret = secret
+      return secret, nil
+    }
+  }
+}
+
+func (repository *SqlRepository) PutLease(lease Lease) (error) {
+  _, err := repository.db.Exec(`INSERT INTO lease (address, created, last_seen, released, expires, claimed, public_key) VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (address) DO UPDATE SET created = $2, last_seen = $3, released = $4, expires = $5, claimed = $6, public_key = $7`,
+    lease.Address, sqlTime(lease.Created), sqlTime(lease.LastSeen), sqlTime(lease.Released), sqlTime(lease.Expires), sqlBool(lease.Claimed), lease.Key)
+  return err
+}
+func (repository *SqlRepository) GetLease(address string) (Lease, error) {
+  lease, err := sqlScanLease(repository.db.QueryRow(`SELECT address, created, last_seen, released, expires, claimed, public_key FROM lease WHERE address = $1`, address))
+  if err == sql.ErrNoRows {
+    return lease, ErrNoSuchLease
+  }
+  return lease, err
+}
+// removes and returns a lease that expired before now. Where 
+// nodes race to reclaim the same lease, only one deletes it.
+func (repository *SqlRepository) ReclaimLease(now time.Time) (Lease, bool, error) {
+  lease, err := sqlScanLease(repository.db.QueryRow(`DELETE FROM lease WHERE address = (SELECT address FROM lease WHERE expires < $1 LIMIT 1)
+    RETURNING address, created, last_seen, released, expires, claimed, public_key`, sqlTime(now)))
+  if err == sql.ErrNoRows {
+    return lease, false, nil
+  } else if err != nil {
+    return lease, false, err
+  }
+  return lease, true, nil
+}
+
+// replaces the lease on the address of the given lease, if the 
+// lease held was created at the same time, and is not released.
+// returns false if not.
+func (repository *SqlRepository) UpdateLease(lease Lease) (bool, error) {
+  if result, err := repository.db.Exec(`UPDATE lease SET last_seen = $1, released = $2, expires = $3, claimed = $4, public_key = $5 
+    WHERE address = $6 AND created = $7 AND released = 0`,
+    sqlTime(lease.LastSeen), sqlTime(lease.Released), sqlTime(lease.Expires), sqlBool(lease.Claimed), lease.Key, lease.Address, sqlTime(lease.Created)); err != nil {
+    return false, err
+  } else if count, err := result.RowsAffected(); err != nil {
+    return false, err
+  } else {
+    return count > 0, nil
+  }
+}
+
+// writes the given lease, if no lease is held on its address. 
+// returns false if one is.
+func (repository *SqlRepository) CreateLease(lease Lease) (bool, error) {
+  if result, err := repository.db.Exec(`INSERT INTO lease (address, created, last_seen, released, expires, claimed, public_key) VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (address) DO NOTHING`,
+    lease.Address, sqlTime(lease.Created), sqlTime(lease.LastSeen), sqlTime(lease.Released), sqlTime(lease.Expires), sqlBool(lease.Claimed), lease.Key); err != nil {
+    return false, err
+  } else if count, err := result.RowsAffected(); err != nil {
+    return false, err
+  } else {
+    return count > 0, nil
+  }
+}
+// writes the given lease, if no lease is held on its address, or
+// the lease held was released, or last seen at or before stale. 
+// returns false if not.
+func (repository *SqlRepository) AcquireLease(lease Lease, stale time.Time) (bool, error) {
+  if result, err := repository.db.Exec(`INSERT INTO lease (address, created, last_seen, released, expires, claimed, public_key) VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (address) DO UPDATE SET created = $2, last_seen = $3, released = $4, expires = $5, claimed = $6, public_key = $7 
+    WHERE lease.released <> 0 OR lease.last_seen <= $8`,
+    lease.Address, sqlTime(lease.Created), sqlTime(lease.LastSeen), sqlTime(lease.Released), sqlTime(lease.Expires), sqlBool(lease.Claimed), lease.Key, sqlTime(stale)); err != nil {
+    return false, err
+  } else if count, err := result.RowsAffected(); err != nil {
+    return false, err
+  } else {
+    return count > 0, nil
+  }
+}
+
+func (repository *SqlRepository) PutClaim(claim Claim) (error) {
+  _, err := repository.db.Exec(`INSERT INTO claim (address, secret, created) VALUES ($1, $2, $3)
+    ON CONFLICT (address) DO UPDATE SET secret = $2, created = $3`,
+    claim.Address, claim.Secret, sqlTime(claim.Created))
+  return err
+}
+func (repository *SqlRepository) GetClaim(address string) (Claim, error) {
+  var claim Claim
+  var created int64
+  if err := repository.db.QueryRow(`SELECT address, secret, created FROM claim WHERE address = $1`, address).Scan(&claim.Address, &claim.Secret, &created); err == sql.ErrNoRows {
+    return claim, ErrNoSuchClaim
+  } else if err != nil {
+    return claim, err
+  }
+  claim.Created = sqlTimeValue(created)
+  return claim, nil
+}
+
+func (repository *SqlRepository) GetKeys() ([]Key, error) {
+  rows, err := repository.db.Query(`SELECT id, value, created FROM secret_key`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var keys []Key
+  for rows.Next() {
+    var key Key
+    var created int64
+    if err := rows.Scan(&key.Id, &key.Value, &created); err != nil {
+      return nil, err
+    }
+    key.Created = sqlTimeValue(created)
+    keys = append(keys, key)
+  }
+  return keys, rows.Err()
+}
+// adds the given key, unless a key of the same id is held. returns
+// false if so.
+func (repository *SqlRepository) AddKey(key Key) (bool, error) {
+  if result, err := repository.db.Exec(`INSERT INTO secret_key (id, value, created) VALUES ($1, $2, $3)
+    ON CONFLICT (id) DO NOTHING`,
+    key.Id, key.Value, sqlTime(key.Created)); err != nil {
+    return false, err
+  } else if count, err := result.RowsAffected(); err != nil {
+    return false, err
+  } else {
+    return count == 1, nil
+  }
+}
+func (repository *SqlRepository) DeleteKey(id int64) (error) {
+  _, err := repository.db.Exec(`DELETE FROM secret_key WHERE id = $1`, id)
+  return err
+}
+
+// puts the given nonce, unless a nonce of the same value expires 
+// after now. returns false if so. Where nodes race to put the same
+// nonce, only one puts it.
+func (repository *SqlRepository) PutNonce(nonce Nonce, now time.Time) (bool, error) {
+  if _, err := repository.db.Exec(`DELETE FROM nonce WHERE expires < $1`, sqlTime(now)); err != nil {
+    return false, err
+  }
+  if result, err := repository.db.Exec(`INSERT INTO nonce (value, expires) VALUES ($1, $2)
+    ON CONFLICT (value) DO UPDATE SET expires = $2 WHERE nonce.expires < $3`,
+    nonce.Value, sqlTime(nonce.Expires), sqlTime(now)); err != nil {
+    return false, err
+  } else if count, err := result.RowsAffected(); err != nil {
+    return false, err
+  } else {
+    return count > 0, nil
+  }
+}
+
+func (repository *SqlRepository) PutRevocation(revocation Revocation, now time.Time) (error) {
+  if _, err := repository.db.Exec(`DELETE FROM revocation WHERE expires < $1`, sqlTime(now)); err != nil {
+    return err
+  }
+  _, err := repository.db.Exec(`INSERT INTO revocation (address, revoked, expires) VALUES ($1, $2, $3)
+    ON CONFLICT (address) DO UPDATE SET revoked = $2, expires = $3`,
+    revocation.Address, sqlTime(revocation.Revoked), sqlTime(revocation.Expires))
+  return err
+}
+func (repository *SqlRepository) GetRevocation(address string) (Revocation, error) {
+  var revocation Revocation
+  var revoked, expires int64
+  if err := repository.db.QueryRow(`SELECT address, revoked, expires FROM revocation WHERE address = $1`, address).Scan(&revocation.Address, &revoked, &expires); err == sql.ErrNoRows {
+    return revocation, ErrNoSuchRevocation
+  } else if err != nil {
+    return revocation, err
+  }
+  revocation.Revoked = sqlTimeValue(revoked)
+  revocation.Expires = sqlTimeValue(expires)
+  return revocation, nil
+}
+
+// imports the records of the given export, replacing the 
+// records held in this repository.
+func (repository *SqlRepository) Import(export Export) error {
+  if _, err := base64.URLEncoding.DecodeString(export.SECRET.Value); err != nil {
+    return err
+  }
+  repository.mutex.Lock()
+  defer repository.mutex.Unlock()
+  repository.secret = nil
+  if tx, err := repository.db.Begin(); err != nil {
+    return err
+  } else {
+    if _, err := tx.Exec(`UPDATE dhcp SET ordinal = $1 WHERE id = 0`, export.DHCP.Ordinal); err != nil {
+      tx.Rollback()
+      return err
+    }
+    if _, err := tx.Exec(`DELETE FROM secret WHERE id = 0`); err != nil {
+      tx.Rollback()
+      return err
+    }
+    if _, err := tx.Exec(`INSERT INTO secret (id, value) VALUES (0, $1)`, export.SECRET.Value); err != nil {
+      tx.Rollback()
+      return err
+    }
+    if _, err := tx.Exec(`DELETE FROM secret_key`); err != nil {
+      tx.Rollback()
+      return err
+    }
+    for _, key := range export.KEY {
+      if _, err := tx.Exec(`INSERT INTO secret_key (id, value, created) VALUES ($1, $2, $3)`, key.Id, key.Value, sqlTime(key.Created)); err != nil {
+        tx.Rollback()
+        return err
+      }
+    }
+    return tx.Commit()
+  }
+}
+
+// closes the underlying database.
+func (repository *SqlRepository) Close() error {
+  return repository.db.Close()
+}
+
+// creates a new repository on the given database, migrating
+// the schema to the latest version.
+func NewSqlRepository(db *sql.DB) (* SqlRepository, error) {
+  var repository = new(SqlRepository)
+  repository.db = db
+  if err := repository.migrate(); err != nil {
+    return nil, err
+  }
+  return repository, nil
+}
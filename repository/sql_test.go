@@ -0,0 +1,121 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package repository
+
+import "sync"
+import "testing"
+import "path/filepath"
+import "database/sql"
+import _ "github.com/mattn/go-sqlite3"
+
+// opens a sql repository on the sqlite file at the given path.
+func openSqlite(t *testing.T, path string) *SqlRepository {
+  db, err := sql.Open("sqlite3", "file:" + path + "?_busy_timeout=10000")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { db.Close() })
+  repository, err := NewSqlRepository(db)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return repository
+}
+
+func TestSqlMigrate(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "hub.db")
+  openSqlite(t, path)
+  repository := openSqlite(t, path)
+  var applied int
+  if err := repository.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+    t.Fatal(err)
+  }
+  if applied != len(sqlMigrations) {
+    t.Fatalf("expected %d migrations, got %d", len(sqlMigrations), applied)
+  }
+}
+
+func TestSqlMigrateConcurrent(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "hub.db")
+  var group sync.WaitGroup
+  errs := make(chan error, 8)
+  for i := 0; i < 8; i++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      if db, err := sql.Open("sqlite3", "file:" + path + "?_busy_timeout=10000"); err != nil {
+        errs <- err
+      } else {
+        defer db.Close()
+        if _, err := NewSqlRepository(db); err != nil {
+          errs <- err
+        }
+      }
+    }()
+  }
+  group.Wait()
+  close(errs)
+  for err := range errs {
+    t.Error(err)
+  }
+}
+
+func TestSqlNextOrdinal(t *testing.T) {
+  path  := filepath.Join(t.TempDir(), "hub.db")
+  nodes := []*SqlRepository { openSqlite(t, path), openSqlite(t, path) }
+  const workers = 16
+  const count   = 1000
+  var mutex sync.Mutex
+  var group sync.WaitGroup
+  seen := make(map[int64]bool)
+  for i := 0; i < workers; i++ {
+    group.Add(1)
+    go func(node *SqlRepository) {
+      defer group.Done()
+      for j := 0; j < count / workers; j++ {
+        if ordinal, err := node.NextOrdinal(); err != nil {
+          t.Error(err)
+        } else {
+          mutex.Lock()
+          if seen[ordinal] {
+            t.Errorf("ordinal %d allocated twice", ordinal)
+          }
+          seen[ordinal] = true
+          mutex.Unlock()
+        }
+      }
+    }(nodes[i % len(nodes)])
+  }
+  group.Wait()
+  if ordinal, err := nodes[0].GetDhcpOrdinal(); err != nil {
+    t.Fatal(err)
+  } else if ordinal != int64(len(seen)) || len(seen) != workers * (count / workers) {
+    t.Fatalf("expected %d ordinals, got %d ordinal and %d seen", workers * (count / workers), ordinal, len(seen))
+  }
+}
@@ -0,0 +1,180 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "net"
+    "strings"
+    "net/http"
+    "crypto/subtle"
+    "crypto/sha256"
+    "encoding/base64"
+    "repository"
+)
+
+// the header clients holding a binding secret send it in.
+const BindingHeader = "X-Hub-Binding"
+
+// binds identities to the client they were issued to, so that a
+// identity presented by another client is rejected.
+type Binding interface {
+    // binds a new identity to the given request. returns the binding
+    // held in the identity, and a secret for the client, or "".
+    Bind(r *http.Request) (string, string, error)
+    // returns true if the given request matches the given binding.
+    Verify(r *http.Request, binding string) bool
+}
+
+// returns the ip of the given remote address, without the port.
+func host(remoteAddr string) net.IP {
+    if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+        return net.ParseIP(host)
+    }
+    return net.ParseIP(remoteAddr)
+}
+
+// returns the given ip as a string, or the given remote address
+// if the ip could not be parsed.
+func ipString(ip net.IP, remoteAddr string) string {
+    if ip == nil {
+        return remoteAddr
+    }
+    return ip.String()
+}
+
+// binds identities to the ip of the client, ignoring the port.
+type IPBinding struct {}
+func (binding IPBinding) Bind(r *http.Request) (string, string, error) {
+    return ipString(host(r.RemoteAddr), r.RemoteAddr), "", nil
+}
+func (binding IPBinding) Verify(r *http.Request, value string) bool {
+    return ipString(host(r.RemoteAddr), r.RemoteAddr) == value
+}
+
+// binds identities to the network of the client, so that clients
+// moving between addresses of one network keep their identity.
+type PrefixBinding struct {
+    IPv4 int
+    IPv6 int
+}
+
+// binds identities to the /24 or /64 network of the client.
+var DefaultPrefixBinding = PrefixBinding { IPv4: 24, IPv6: 64 }
+
+func (binding PrefixBinding) network(ip net.IP) string {
+    if ip == nil {
+        return ""
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return ip4.Mask(net.CIDRMask(binding.IPv4, 32)).String()
+    }
+    return ip.Mask(net.CIDRMask(binding.IPv6, 128)).String()
+}
+func (binding PrefixBinding) Bind(r *http.Request) (string, string, error) {
+    return binding.network(host(r.RemoteAddr)), "", nil
+}
+func (binding PrefixBinding) Verify(r *http.Request, value string) bool {
+    network := binding.network(host(r.RemoteAddr))
+    return network != "" && network == value
+}
+
+// binds identities to the ip of the client behind trusted proxies,
+// taken from the X-Forwarded-For header. The header is read from 
+// the right, skipping proxies, so clients can not spoof their ip
+// by sending the header themselves.
+type ForwardedBinding struct {
+    Proxies []*net.IPNet
+}
+
+func (binding ForwardedBinding) trusted(ip net.IP) bool {
+    for _, proxy := range binding.Proxies {
+        if proxy.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// returns the ip of the client.
+func (binding ForwardedBinding) client(r *http.Request) net.IP {
+    ip := host(r.RemoteAddr)
+    if ip == nil || !binding.trusted(ip) {
+        return ip
+    }
+    hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            return ip
+        }
+        ip = hop
+        if !binding.trusted(hop) {
+            return hop
+        }
+    }
+    return ip
+}
+func (binding ForwardedBinding) Bind(r *http.Request) (string, string, error) {
+    return ipString(binding.client(r), r.RemoteAddr), "", nil
+}
+func (binding ForwardedBinding) Verify(r *http.Request, value string) bool {
+    return ipString(binding.client(r), r.RemoteAddr) == value
+}
+
+// binds identities to a random secret held by the client, sent
+// in the X-Hub-Binding header. Identities hold a hash of the 
+// secret. Clients keep their identity across any network change.
+type SecretBinding struct {}
+
+func secretHash(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return base64.URLEncoding.EncodeToString(sum[:])
+}
+func (binding SecretBinding) Bind(r *http.Request) (string, string, error) {
+    if bytes, err := repository.GenerateRandomBytes(24); err != nil {
+        return "", "", err
+    } else {
+        secret := base64.URLEncoding.EncodeToString(bytes)
+        return secretHash(secret), secret, nil
+    }
+}
+func (binding SecretBinding) Verify(r *http.Request, value string) bool {
+    secret := r.Header.Get(BindingHeader)
+    return secret != "" && subtle.ConstantTimeCompare([]byte(secretHash(secret)), []byte(value)) == 1
+}
+
+// does not bind identities, any client holding a identity may
+// use it.
+type NoBinding struct {}
+func (binding NoBinding) Bind(r *http.Request) (string, string, error) {
+    return "", "", nil
+}
+func (binding NoBinding) Verify(r *http.Request, value string) bool {
+    return true
+}
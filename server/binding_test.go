@@ -0,0 +1,115 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+
+package server
+
+import (
+    "net"
+    "testing"
+    "net/http/httptest"
+)
+
+func TestForwardedBinding(t *testing.T) {
+    _, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+    _, edge, _    := net.ParseCIDR("2001:db8:ffff::/48")
+    binding := ForwardedBinding { Proxies: []*net.IPNet { proxies, edge } }
+    tests := []struct {
+        name      string
+        remote    string
+        forwarded string
+        expected  string
+    } {
+        { "direct client",                 "192.0.2.1:1234",           "",                               "192.0.2.1" },
+        { "untrusted peer ignores header", "192.0.2.1:1234",           "198.51.100.7",                   "192.0.2.1" },
+        { "trusted proxy",                 "10.0.0.1:80",              "198.51.100.7",                   "198.51.100.7" },
+        { "spoofed leftmost entries",      "10.0.0.1:80",              "203.0.113.9, 10.1.1.1, 198.51.100.7", "198.51.100.7" },
+        { "chain of trusted proxies",      "10.0.0.1:80",              "198.51.100.7, 10.2.2.2, 10.1.1.1", "198.51.100.7" },
+        { "spoof behind proxy chain",      "10.0.0.1:80",              "203.0.113.9, 198.51.100.7, 10.1.1.1", "198.51.100.7" },
+        { "trusted proxy without header",  "10.0.0.1:80",              "",                               "10.0.0.1" },
+        { "malformed hop",                 "10.0.0.1:80",              "198.51.100.7, garbage",          "10.0.0.1" },
+        { "all hops trusted",              "10.0.0.1:80",              "10.3.3.3, 10.1.1.1",             "10.3.3.3" },
+        { "ipv4 mapped trusted proxy",     "[::ffff:10.0.0.1]:80",     "198.51.100.7",                   "198.51.100.7" },
+        { "ipv4 mapped client",            "10.0.0.1:80",              "::ffff:198.51.100.7",            "198.51.100.7" },
+        { "ipv4 mapped untrusted peer",    "[::ffff:192.0.2.1]:1234",  "198.51.100.7",                   "192.0.2.1" },
+        { "ipv6 trusted proxy",            "[2001:db8:ffff::1]:80",    "2001:db8:1::7",                  "2001:db8:1::7" },
+        { "ipv6 untrusted peer",           "[2001:db8:fffe::1]:80",    "2001:db8:1::7",                  "2001:db8:fffe::1" },
+    }
+    for _, test := range tests {
+        r := httptest.NewRequest("GET", "/connect", nil)
+        r.RemoteAddr = test.remote
+        if test.forwarded != "" {
+            r.Header.Set("X-Forwarded-For", test.forwarded)
+        }
+        if bound, _, err := binding.Bind(r); err != nil || bound != test.expected {
+            t.Errorf("%s: expected %s, got %s %v", test.name, test.expected, bound, err)
+        } else if !binding.Verify(r, test.expected) {
+            t.Errorf("%s: expected %s verified", test.name, test.expected)
+        }
+    }
+}
+
+func TestPrefixBinding(t *testing.T) {
+    tests := []struct {
+        name     string
+        bound    string
+        remote   string
+        verified bool
+    } {
+        { "same ipv4 address",           "192.0.2.1:1234",            "192.0.2.1:4321",            true },
+        { "same ipv4 /24",               "192.0.2.1:1234",            "192.0.2.254:1234",          true },
+        { "ipv4 /24 lower boundary",     "192.0.2.255:1234",          "192.0.2.0:1234",            true },
+        { "next ipv4 /24",               "192.0.2.255:1234",          "192.0.3.0:1234",            false },
+        { "previous ipv4 /24",           "192.0.2.0:1234",            "192.0.1.255:1234",          false },
+        { "ipv4 mapped same /24",        "192.0.2.1:1234",            "[::ffff:192.0.2.200]:1234", true },
+        { "ipv4 mapped other /24",       "[::ffff:192.0.2.1]:1234",   "192.0.3.1:1234",            false },
+        { "same ipv6 /64",               "[2001:db8:0:1::1]:1234",    "[2001:db8:0:1:ffff:ffff:ffff:ffff]:1234", true },
+        { "next ipv6 /64",               "[2001:db8:0:1:ffff:ffff:ffff:ffff]:1234", "[2001:db8:0:2::]:1234", false },
+        { "ipv4 against ipv6",           "192.0.2.1:1234",            "[2001:db8::1]:1234",        false },
+        { "unparseable remote",          "192.0.2.1:1234",            "nonsense",                  false },
+    }
+    for _, test := range tests {
+        issued := httptest.NewRequest("GET", "/connect", nil)
+        issued.RemoteAddr = test.bound
+        bound, _, err := DefaultPrefixBinding.Bind(issued)
+        if err != nil {
+            t.Fatal(err)
+        }
+        r := httptest.NewRequest("GET", "/forward", nil)
+        r.RemoteAddr = test.remote
+        if verified := DefaultPrefixBinding.Verify(r, bound); verified != test.verified {
+            t.Errorf("%s: expected verified %v, got %v for %s", test.name, test.verified, verified, bound)
+        }
+    }
+    // clients with no parseable ip are never bound to a network.
+    r := httptest.NewRequest("GET", "/forward", nil)
+    r.RemoteAddr = "nonsense"
+    if DefaultPrefixBinding.Verify(r, "") {
+        t.Fatal("expected unparseable remote not verified against a empty binding")
+    }
+}
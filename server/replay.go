@@ -0,0 +1,132 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "time"
+    "strconv"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "repository"
+)
+
+// the longest nonce accepted on a forward.
+const MaxNonceLength = 64
+
+// rejects forwards replaying a nonce already seen from the same 
+// sender. Nonces are held in the repository until the timestamp of
+// the forward falls outside the signature window, after which the
+// forward is rejected by its timestamp. The nonce and timestamp 
+// are covered by the signature of signed forwards, and by a mac on
+// identity forwards, keyed with a replay key given to the client 
+// with its identity, so a captured forward can not be replayed 
+// with its nonce changed or removed. Identities issued before 
+// replay keys were introduced carry no key, and their forwards are
+// checked only against replays of the forward as sent.
+type ReplayCache struct {
+    repository repository.Repository
+}
+
+// returns the base64url replay key of the given identity token, 
+// derived from the repository secret, so is never stored.
+func (cache *ReplayCache) Key(token string) (string, error) {
+    if secret, err := cache.repository.GetSecretKey(); err != nil {
+        return "", err
+    } else {
+        derived := hmac.New(sha256.New, secret)
+        derived.Write([]byte("replay-key"))
+        mac := hmac.New(sha256.New, derived.Sum(nil))
+        mac.Write([]byte(token))
+        return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+    }
+}
+
+// verifies the mac of the given identity forward, the base64url 
+// HMAC-SHA256 of its nonce, timestamp, from, to and data, each 
+// followed by a newline, keyed with the replay key of its identity.
+// returns a non zero error code if the forward has no nonce, or the
+// mac does not match.
+func (cache *ReplayCache) Verify(request ForwardRequest) int16 {
+    if request.Nonce == "" {
+        return ForwardSignatureError
+    } else if key, err := cache.Key(request.Identity); err != nil {
+        return InternalServerError
+    } else if secret, err := base64.URLEncoding.DecodeString(key); err != nil {
+        return InternalServerError
+    } else if expected, err := base64.URLEncoding.DecodeString(request.Mac); err != nil {
+        return ForwardSignatureError
+    } else {
+        mac := hmac.New(sha256.New, secret)
+        for _, field := range []string { request.Nonce, strconv.FormatInt(request.Timestamp, 10), request.From, request.To, request.Data } {
+            mac.Write([]byte(field + "\n"))
+        }
+        if !hmac.Equal(mac.Sum(nil), expected) {
+            return ForwardSignatureError
+        }
+    }
+    return 0
+}
+
+// checks the nonce of the given forward from the given address, 
+// if it has one. returns a non zero error code if the forward is 
+// malformed, outside the signature window, or a replay.
+func (cache *ReplayCache) Check(address string, request ForwardRequest) int16 {
+    if request.Nonce == "" {
+        return 0
+    }
+    return cache.CheckNonce(address, request.Nonce, request.Timestamp)
+}
+
+// checks the given nonce and timestamp of a request from the given 
+// address. returns a non zero error code if the nonce is malformed,
+// the timestamp outside the signature window, or the nonce was seen.
+func (cache *ReplayCache) CheckNonce(address string, nonce string, timestamp int64) int16 {
+    now := time.Now()
+    if len(nonce) > MaxNonceLength {
+        return ForwardDeserializeError
+    } else if skew := now.Sub(time.Unix(timestamp, 0)); skew > SignatureWindow || skew < -SignatureWindow {
+        return ForwardTimestampError
+    } else if put, err := cache.repository.PutNonce(repository.Nonce {
+        Value   : address + "/" + nonce,
+        Expires : time.Unix(timestamp, 0).Add(SignatureWindow),
+    }, now); err != nil {
+        return InternalServerError
+    } else if !put {
+        return ForwardReplayError
+    }
+    return 0
+}
+
+// creates a new replay cache held in the given repository.
+func NewReplayCache(repository repository.Repository) * ReplayCache {
+    cache := new(ReplayCache)
+    cache.repository = repository
+    return cache
+}
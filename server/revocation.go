@@ -0,0 +1,83 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "time"
+    "repository"
+)
+
+// revokes the identities issued for a address, held in the 
+// repository until the revoked identities have expired. Revoking 
+// a address leaves identities issued for it afterwards valid.
+type RevocationList struct {
+    repository repository.Repository
+}
+
+// revokes the identities issued for the given address up to now.
+// The datastore holds times to the microsecond, so the revocation
+// is rounded up to the next microsecond, revoking identities issued
+// in the microsecond it was made. Identities without issue times 
+// are accepted until the given legacy cutoff, so the revocation is
+// held until the later of the cutoff and the identity lifetime.
+func (list *RevocationList) Revoke(address string, legacy time.Time) error {
+    now     := time.Now()
+    expires := now.Add(IdentityLifetime)
+    if legacy.After(expires) {
+        expires = legacy
+    }
+    return list.repository.PutRevocation(repository.Revocation {
+        Address : key(address),
+        Revoked : now.Truncate(time.Microsecond).Add(time.Microsecond),
+        Expires : expires,
+    }, now)
+}
+
+// returns true if the given identity was revoked, if issued before
+// the revocation. Identities issued before issue times were held to
+// the nanosecond are compared to the second, so are revoked if 
+// issued in the second of the revocation.
+func (list *RevocationList) Revoked(identity Identity) (bool, error) {
+    if revocation, err := list.repository.GetRevocation(key(identity.Address)); err == repository.ErrNoSuchRevocation {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    } else if identity.IssuedNano != 0 {
+        return identity.IssuedNano < revocation.Revoked.UnixNano(), nil
+    } else {
+        return identity.IssuedAt <= revocation.Revoked.Unix(), nil
+    }
+}
+
+// creates a new revocation list held in the given repository.
+func NewRevocationList(repository repository.Repository) * RevocationList {
+    list := new(RevocationList)
+    list.repository = repository
+    return list
+}
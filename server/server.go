@@ -0,0 +1,885 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "io/ioutil"
+    "time"
+    "strconv"
+    "encoding/json"
+    "dhcp"
+    "encryption"
+    "transport"
+)
+
+// api error constants.
+const (
+    InternalServerError              = 600
+    ConnectAddressAllocationError    = 700
+    ConnectChannelInitializeError    = 701
+    ConnectIdentitySerializeError    = 702
+    ConnectEncryptionError           = 703
+    ConnectTransportError            = 704
+    ConnectAddressExhaustedError     = 705
+    ConnectClaimError                = 706
+    ConnectAddressInUseError         = 707
+    ConnectKeyError                  = 708
+    ForwardHttpStreamError           = 800
+    ForwardDeserializeError          = 801
+    ForwardDecryptionError           = 802
+    ForwardDeserializeIdentityError  = 803
+    ForwardIdentityVerificationError = 804
+    ForwardSerializeError            = 805   
+    ForwardAddressReleasedError      = 806
+    ForwardRecipientError            = 807
+    ForwardChecksumError             = 808
+    ForwardSenderError               = 809
+    ForwardIdentityExpiredError      = 810
+    ForwardSignatureError            = 811
+    ForwardTimestampError            = 812
+    ForwardReplayError               = 813
+    ForwardIdentityRevokedError      = 814
+    ForwardRecipientOfflineError     = 815
+    ForwardDeliveryError             = 816
+    PollTransportError               = 900
+    PollReceiveError                 = 901
+    AdminClaimError                  = 1000
+    AdminRotateError                 = 1001
+    AdminRevokeError                 = 1002
+    KeysPublishError                 = 1100
+)
+var errorText = map[int16] string {
+    InternalServerError              : "internal server error.",
+    ConnectAddressAllocationError    : "unable to allocate address.",
+    ConnectChannelInitializeError    : "unable to initialize data channel.",
+    ConnectEncryptionError           : "unable to encrypt identity.",
+    ConnectTransportError            : "unknown transport.",
+    ConnectAddressExhaustedError     : "address space exhausted.",
+    ConnectClaimError                : "address claim rejected.",
+    ConnectAddressInUseError         : "address in use.",
+    ConnectKeyError                  : "unable to bind public key.",
+    ForwardHttpStreamError           : "unable to read from http input stream.",
+    ForwardDeserializeError          : "unable to deserialize user request.",
+    ForwardDecryptionError           : "unable to decrypt user identity",
+    ForwardDeserializeIdentityError  : "unable to deserialize identity",
+    ForwardIdentityVerificationError : "unable to verify user identity.",
+    ForwardSerializeError            : "unable to serialize forwarded message.",
+    ForwardAddressReleasedError      : "address lease released.",
+    ForwardRecipientError            : "invalid recipient address.",
+    ForwardChecksumError             : "recipient address checksum mismatch.",
+    ForwardSenderError               : "invalid sender address.",
+    ForwardIdentityExpiredError      : "identity expired.",
+    ForwardSignatureError            : "unable to verify signature.",
+    ForwardTimestampError            : "request timestamp outside window.",
+    ForwardReplayError               : "request replayed.",
+    ForwardIdentityRevokedError      : "identity revoked.",
+    ForwardRecipientOfflineError     : "recipient not connected.",
+    ForwardDeliveryError             : "unable to deliver message.",
+    PollTransportError               : "long polling not available.",
+    PollReceiveError                 : "no mailbox open for address.",
+    AdminClaimError                  : "unable to claim address, address not reserved.",
+    AdminRotateError                 : "key rotation not available.",
+    AdminRevokeError                 : "unable to revoke address.",
+    KeysPublishError                 : "no verification keys published.",
+}
+
+type Error struct {
+    Code    int16        `json:"code"`
+    Message string       `json:"message"`
+}
+type RequestError struct {
+    Error   Error        `json:"error"`
+}
+type RequestOk struct {
+    Data    interface {} `json:"data"`
+}
+
+// services used by the hub to handle a single request. These
+// are resolved per request, allowing hosts such as appengine
+// to bind services to the request context.
+type Services struct {
+    Formatter   dhcp.AddressFormatter
+    Allocator   dhcp.AddressAllocator
+    Claims      *dhcp.ClaimRegistry
+    Encryption  encryption.EncryptionProvider
+    Transport   *transport.Selector
+    Binding     Binding
+    Replay      *ReplayCache
+    Revocations *RevocationList
+    LegacyUntil time.Time
+}
+
+// returns the dotted form of the given address, which keys the 
+// transports, revocations and nonces of the address whatever the 
+// format of the hub. Invalid addresses are returned as given.
+func key(address string) string {
+    if canonical, err := dhcp.Canonical(address); err != nil {
+        return address
+    } else {
+        return canonical
+    }
+}
+
+// checks the given forward from the given address is not a replay,
+// if the services hold a replay cache.
+func replay(services Services, address string, request ForwardRequest) int16 {
+    if services.Replay == nil {
+        return 0
+    }
+    return services.Replay.Check(key(address), request)
+}
+
+// verifies the mac of the given identity forward, if the identity
+// holds a replay key and the services hold a replay cache.
+func verifyMac(services Services, identity Identity, request ForwardRequest) int16 {
+    if !identity.Replay || services.Replay == nil {
+        return 0
+    }
+    return services.Replay.Verify(request)
+}
+
+// returns true if the given identity was revoked, if the services
+// hold a revocation list.
+func revoked(services Services, identity Identity) (bool, error) {
+    if services.Revocations == nil {
+        return false, nil
+    }
+    return services.Revocations.Revoked(identity)
+}
+
+// disconnects the given address, revoking the identities issued 
+// for it, closing its transport and releasing its lease.
+func disconnect(services Services, address string) error {
+    if services.Revocations != nil {
+        if err := services.Revocations.Revoke(address, services.LegacyUntil); err != nil {
+            return err
+        }
+    }
+    if err := services.Transport.Close(key(address)); err != nil {
+        return err
+    }
+    return services.Allocator.Release(address)
+}
+
+// returns the binding of the given services, binding identities
+// to the client ip if none is set.
+func binding(services Services) Binding {
+    if services.Binding == nil {
+        return IPBinding {}
+    }
+    return services.Binding
+}
+
+// resolves the hub services for the given request.
+type ServiceProvider func(r *http.Request) Services
+
+// the hub server. serves the connect and forward api, and 
+// is hosted either by appengine or the standalone server.
+type Server struct {
+    services ServiceProvider
+}
+
+// registers the hub api on the given mux.
+func (server *Server) Register(mux *http.ServeMux) {
+    mux.Handle("/connect", Cors(http.HandlerFunc(server.Connect)))
+    mux.Handle("/forward", Cors(http.HandlerFunc(server.Forward)))
+    mux.Handle("/poll",    Cors(http.HandlerFunc(server.Poll)))
+    mux.Handle("/refresh",    Cors(http.HandlerFunc(server.Refresh)))
+    mux.Handle("/disconnect", Cors(http.HandlerFunc(server.Disconnect)))
+    mux.Handle("/keys",       Cors(http.HandlerFunc(server.Keys)))
+}
+
+// registers the hub admin api on the given mux. Admin endpoints
+// must be restricted to operators by the host.
+func (server *Server) RegisterAdmin(mux *http.ServeMux) {
+    mux.Handle("/admin/status", http.HandlerFunc(server.Status))
+    mux.Handle("/admin/claim",  http.HandlerFunc(server.Claim))
+    mux.Handle("/admin/rotate", http.HandlerFunc(server.Rotate))
+    mux.Handle("/admin/revoke", http.HandlerFunc(server.Revoke))
+}
+
+// creates a new hub server with the given service provider.
+func NewServer(services ServiceProvider) * Server {
+    server := new(Server)
+    server.services = services
+    return server
+}
+
+// cross origin middleware.
+func Cors(next http.Handler) http.Handler {
+    fc := func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Access-Control-Allow-Origin", "*")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", "Origin, Accept, X-Requested-With, Content-Type, " + BindingHeader + ", " + SignatureHeader)
+        if r.Method == "OPTIONS" {
+            w.WriteHeader(200)
+            w.Write([]byte(""))
+            return
+        }
+        next.ServeHTTP(w, r)
+    }
+    return http.HandlerFunc(fc)
+}
+
+// writes a standard api json error on the given response.
+func WriteError (w http.ResponseWriter, code int16) {
+    output := RequestError {
+        Error: Error {
+            Code    : code,
+            Message : errorText[code],
+        },
+    }
+    if json, err := json.MarshalIndent(output, "", " "); err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(500)
+        w.Write([]byte(fmt.Sprintf("{error:{ \"code\": %d, \"message\": \"%s\" }}", 
+            InternalServerError, 
+            errorText[InternalServerError],
+        )))
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(500)
+        w.Write(json)
+    }
+}
+
+// writes a standard api json ok on the given response.
+func WriteOk (w http.ResponseWriter, data interface {}) {
+    output := RequestOk { 
+        Data: data,
+    }
+    if json, err := json.MarshalIndent(output, "", " "); err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(500)
+        w.Write([]byte(fmt.Sprintf("{error:{ \"code\": %d, \"message\": \"%s\" }}", 
+            InternalServerError, 
+            errorText[InternalServerError],
+        )))
+    } else {    
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(200)
+        w.Write(json)
+    }
+}
+
+// connection identity. generated on connect
+// and passed on forward, this struct is encrypted
+// between client and server and used to verify
+// the identity of the user forwarding messages.
+type Identity struct {
+    RemoteAddr string `json:"remoteAddr,omitempty"`
+    Binding     string `json:"binding"`
+    Address    string `json:"address"`
+    IssuedAt   int64  `json:"issuedAt"`
+    ExpiresAt  int64  `json:"expiresAt"`
+    IssuedNano int64  `json:"issuedNano,omitempty"`
+    Replay     bool   `json:"replay,omitempty"`
+
+    // the registered json web token claims, the address and times
+    // above, so signed identities verify with standard libraries.
+    Subject    string `json:"sub,omitempty"`
+    Issued     int64  `json:"iat,omitempty"`
+    Expiry     int64  `json:"exp,omitempty"`
+}
+
+// the time after which identities are rejected. Clients swap their
+// identity for a new one on /refresh before it expires.
+const IdentityLifetime = time.Hour
+
+// returns the time this identity expires. Identities issued before
+// issue times were introduced carry no times, and expire at the 
+// given cutoff, the end of the migration window for the tokens of 
+// earlier versions. Identities issued before expiry was introduced
+// expire a lifetime after issue.
+func (identity Identity) Expires(legacy time.Time) time.Time {
+    if identity.IssuedAt == 0 && identity.ExpiresAt == 0 {
+        return legacy
+    } else if identity.ExpiresAt == 0 {
+        return time.Unix(identity.IssuedAt, 0).Add(IdentityLifetime)
+    }
+    return time.Unix(identity.ExpiresAt, 0)
+}
+
+// issues a new encrypted identity for the given address, with the
+// given binding. Where the services hold a replay cache, forwards
+// with the identity must carry a mac keyed with its replay key.
+// returns the identity token and expiry, or a non zero error code.
+func issue(services Services, address string, binding string) (string, int64, int16) {
+    now      := time.Now()
+    identity := Identity {
+        Binding    : binding, 
+        Address    : address, 
+        IssuedAt   : now.Unix(),
+        ExpiresAt  : now.Add(IdentityLifetime).Unix(),
+        IssuedNano : now.UnixNano(),
+        Replay     : services.Replay != nil,
+        Subject    : address,
+        Issued     : now.Unix(),
+        Expiry     : now.Add(IdentityLifetime).Unix(),
+    }
+    if content, err := json.Marshal(identity); err != nil {
+        return "", 0, ConnectIdentitySerializeError
+    } else if token, err := services.Encryption.Encrypt(string(content)); err != nil {
+        return "", 0, ConnectEncryptionError
+    } else {
+        return token, identity.ExpiresAt, 0
+    }
+}
+
+type ConnectResponse struct {
+    Transport   string `json:"transport"`
+    Channel   string `json:"channel"`
+    Identity  string `json:"identity"`
+    Address   string `json:"address"`
+    ExpiresAt int64  `json:"expiresAt"`
+    Binding     string `json:"binding,omitempty"`
+    ReplayKey string `json:"replayKey,omitempty"`
+}
+
+// returns the replay key of the given identity token, if the 
+// services hold a replay cache. returns the key, or a non zero 
+// error code.
+func replayKey(services Services, token string) (string, int16) {
+    if services.Replay == nil {
+        return "", 0
+    } else if key, err := services.Replay.Key(token); err != nil {
+        return "", InternalServerError
+    } else {
+        return key, 0
+    }
+}
+
+// allocates a address for the caller. Callers may request a 
+// reserved address with ?address=...&claim=..., granted if the
+// claim secret matches and the address is not in use. returns
+// the address, or a non zero error code.
+func allocate(services Services, r *http.Request) (string, int16) {
+    query := r.URL.Query()
+    if query.Get("address") == "" {
+        if address, err := services.Allocator.Next(); err != nil {
+            if _, ok := err.(*dhcp.ExhaustedError); ok {
+                return "", ConnectAddressExhaustedError
+            }
+            return "", ConnectAddressAllocationError
+        } else {
+            return address, 0
+        }
+    }
+    if services.Claims == nil {
+        return "", ConnectClaimError
+    }
+    if address, err := services.Claims.Claim(query.Get("address"), query.Get("claim")); err == dhcp.ErrClaimRejected {
+        return "", ConnectClaimError
+    } else if err != nil {
+        return "", ConnectAddressAllocationError
+    } else if err := services.Allocator.Acquire(address); err == dhcp.ErrAddressInUse {
+        return "", ConnectAddressInUseError
+    } else if err != nil {
+        return "", ConnectAddressAllocationError
+    } else {
+        return address, 0
+    }
+}
+
+// abandons the given address, allocated to a connect that then 
+// failed, closing its transport and releasing its lease, so the 
+// address is not held for the lease timeout.
+func abandon(services Services, address string) {
+    services.Transport.Close(key(address))
+    services.Allocator.Release(address)
+}
+
+// creates a new connection to this hub. clients may select
+// a transport with ?transport=..., or receive the default, and
+// may bind a ed25519 public key with ?key=... to sign forwards.
+// The key is checked before a address is allocated, and the 
+// address is released if the connect fails once allocated.
+func (server *Server) Connect (w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+
+    // select transport, and parse the clients key.
+    if transport, err := services.Transport.Select(r.URL.Query().Get("transport")); err != nil {
+        WriteError(w, ConnectTransportError)
+    } else if public_key, code := parseKey(services, r.URL.Query().Get("key")); code != 0 {
+        WriteError(w, code)
+    } else {
+
+        // allocate new address, binding the clients key.
+        if address, code := allocate(services, r); code != 0 {
+            WriteError(w, code)
+        } else if code := bindKey(services, address, public_key); code != 0 {
+            abandon(services, address)
+            WriteError(w, code)
+        } else {
+
+            // open transport.
+            if channel_token, err := transport.Open(key(address)); err != nil {
+                abandon(services, address)
+                WriteError(w, ConnectChannelInitializeError)
+            } else {
+
+                // bind, create and encrypt identity for user.
+                if bound, secret, err := binding(services).Bind(r); err != nil {
+                    abandon(services, address)
+                    WriteError(w, InternalServerError)
+                } else if identity_token, expires, code := issue(services, address, bound); code != 0 {
+                    abandon(services, address)
+                    WriteError(w, code)
+                } else if replay_key, code := replayKey(services, identity_token); code != 0 {
+                    abandon(services, address)
+                    WriteError(w, code)
+                } else {
+
+                    // respond.
+                    WriteOk(w, ConnectResponse { 
+                        Transport: transport.Name(),
+                        Channel  : channel_token, 
+                        Identity : identity_token,
+                        Address  : address,
+                        ExpiresAt: expires,
+                        Binding  : secret,
+                        ReplayKey: replay_key,
+                    })
+                }
+            }
+        }
+    }
+}
+
+// decrypts the identity token given as ?identity=... to the given
+// endpoint and verifies it against the request, renewing the 
+// identities address lease. Requests for addresses with a bound 
+// key must be signed. returns the identity, or a non zero error 
+// code.
+func verify(services Services, r *http.Request, endpoint string) (Identity, int16) {
+    if identity, code := identify(services, r, r.URL.Query().Get("identity")); code != 0 {
+        return identity, code
+    } else if code := authorize(services, r, endpoint, identity); code != 0 {
+        return identity, code
+    } else {
+        return identity, renew(services, identity)
+    }
+}
+
+// decrypts the given identity token and verifies it against
+// the request, without renewing the identities address lease.
+// returns the identity, or a non zero error code.
+func identify(services Services, r *http.Request, token string) (Identity, int16) {
+    var identity Identity
+
+    // decrypt identity token.
+    if content, err := services.Encryption.Decrypt(token); err == encryption.ErrExpiredToken {
+        return identity, ForwardIdentityExpiredError
+    } else if err != nil {
+        return identity, ForwardDecryptionError
+    } else {
+
+        // deserialize identity from token.
+        if err := json.Unmarshal([]byte(content), &identity); err != nil {
+            return identity, ForwardDeserializeIdentityError
+        } else {
+
+            // validate the request against the identity binding. Identities
+            // issued before bindings were introduced hold the remote address.
+            if identity.RemoteAddr != "" && identity.RemoteAddr != r.RemoteAddr {
+                return identity, ForwardIdentityVerificationError
+            } else if identity.RemoteAddr == "" && !binding(services).Verify(r, identity.Binding) {
+                return identity, ForwardIdentityVerificationError
+            } else if time.Now().After(identity.Expires(services.LegacyUntil)) {
+                return identity, ForwardIdentityExpiredError
+            } else if revoked, err := revoked(services, identity); err != nil {
+                return identity, InternalServerError
+            } else if revoked {
+                return identity, ForwardIdentityRevokedError
+            }
+        }
+    }
+    return identity, 0
+}
+
+// renews the address lease of the given identity. returns a non
+// zero error code if the address was released.
+func renew(services Services, identity Identity) int16 {
+    if err := services.Allocator.Renew(identity.Address, time.Unix(identity.IssuedAt, 0)); err == dhcp.ErrLeaseReleased {
+        return ForwardAddressReleasedError
+    } else if err != nil {
+        return InternalServerError
+    }
+    return 0
+}
+
+// normalizes the given address, which may be in any address 
+// format, with a optional sub-address, to the format of the hub. 
+// returns the address, and the address with its sub-address.
+func normalize(services Services, input string) (string, string, error) {
+    if address, err := dhcp.ParseSubAddress(input); err != nil {
+        return "", "", err
+    } else {
+        return services.Formatter.Format(address.Address), address.Format(services.Formatter), nil
+    }
+}
+
+// resolves the sender of a forwarded message, the callers address,
+// or the given sub-address of it. returns the sender, or a non 
+// zero error code.
+func sender(services Services, identity Identity, input string) (string, int16) {
+    if input == "" {
+        return identity.Address, 0
+    }
+    if address, from, err := normalize(services, input); err != nil || key(address) != key(identity.Address) {
+        return "", ForwardSenderError
+    } else {
+        return from, 0
+    }
+}
+
+type ForwardRequest struct {
+    Identity  string `json:"identity"`
+    From      string `json:"from"`
+    To        string `json:"to"`
+    Data      string `json:"data"`
+    Timestamp int64  `json:"timestamp"`
+    Nonce     string `json:"nonce"`
+    Mac       string `json:"mac,omitempty"`
+}
+type ForwardResponse struct {
+    Ok        bool   `json:"ok"`
+}
+type ForwardOutput struct {
+    From     string `json:"from"`
+    To       string `json:"to"`
+    Data     string `json:"data"`
+}
+
+// authenticates the sender of a forward, by its signature if
+// signed, otherwise by its identity. Addresses with a bound key
+// must sign, so a leaked identity can not send for them, and 
+// identities holding a replay key must carry its mac. returns the
+// identity of the sender, or a non zero error code.
+func authenticate(services Services, r *http.Request, request ForwardRequest, content []byte) (Identity, int16) {
+    if r.Header.Get(SignatureHeader) != "" {
+        return verifySignature(services, r, request, content)
+    }
+    if identity, code := identify(services, r, request.Identity); code != 0 {
+        return identity, code
+    } else if code := unsigned(services, identity.Address); code != 0 {
+        return identity, code
+    } else if code := verifyMac(services, identity, request); code != 0 {
+        return identity, code
+    } else {
+        return identity, renew(services, identity)
+    }
+}
+
+// forwards a request onto another user connected to the hub.
+// messages to a sub-address are sent to the connection owning its
+// address, and callers may send from any sub-address of their own.
+func (server *Server) Forward(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    
+    // read http content.
+    defer r.Body.Close()
+    if content, err := ioutil.ReadAll(r.Body); err != nil {
+        WriteError(w, ForwardHttpStreamError)
+    } else {
+
+        // deserialize message.
+        var request ForwardRequest
+        if err := json.Unmarshal(content, &request); err != nil {
+            WriteError(w, ForwardDeserializeError)
+        } else {
+
+            // verify signature or identity.
+            if identity, code := authenticate(services, r, request, content); code != 0 {
+                WriteError(w, code)
+            } else {
+
+                // validate recipient and sender addresses.
+                if address, to, err := normalize(services, request.To); err == dhcp.ErrChecksumMismatch {
+                    WriteError(w, ForwardChecksumError)
+                } else if err != nil {
+                    WriteError(w, ForwardRecipientError)
+                } else if from, code := sender(services, identity, request.From); code != 0 {
+                    WriteError(w, code)
+                } else if code := replay(services, identity.Address, request); code != 0 {
+                    WriteError(w, code)
+                } else {
+
+                    // create forwarded message.
+                    message := ForwardOutput { 
+                        From   : from, 
+                        To     : to,
+                        Data   : request.Data,
+                    }
+                    if output, err := json.Marshal(message); err != nil {
+                        WriteError(w, ForwardSerializeError)
+                    } else {
+
+                        // emit to transport and respond ok.
+                        if err := services.Transport.Send(key(address), string(output)); err == transport.ErrNotConnected {
+                            WriteError(w, ForwardRecipientOfflineError)
+                        } else if err != nil {
+                            WriteError(w, ForwardDeliveryError)
+                        } else {
+                            WriteOk(w, ForwardResponse {  Ok: true, })
+                        }
+                    }
+                }
+            }
+        }
+    }
+}
+
+// the longest a poll waits for a message to arrive.
+const PollTimeout = 30 * time.Second
+
+type PollMessage struct {
+    Id       int64           `json:"id"`
+    Message  json.RawMessage `json:"message"`
+}
+type PollResponse struct {
+    Messages []PollMessage   `json:"messages"`
+}
+
+// long polls for messages forwarded to the callers address. Callers
+// pass their identity, and the id of the last message received as
+// ?since=... The response holds the messages after since, waiting
+// up to ?timeout=... seconds for one to arrive.
+func (server *Server) Poll(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    query    := r.URL.Query()
+    since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+    timeout  := PollTimeout
+    if seconds, err := strconv.ParseInt(query.Get("timeout"), 10, 64); err == nil && seconds >= 0 && time.Duration(seconds) * time.Second < timeout {
+        timeout = time.Duration(seconds) * time.Second
+    }
+
+    // resolve the polling transport.
+    selected, err := services.Transport.Select("poll")
+    receiver, ok  := selected.(transport.Receiver)
+    if err != nil || !ok {
+        WriteError(w, PollTransportError)
+    } else {
+
+        // verify identity.
+        if identity, code := verify(services, r, "poll"); code != 0 {
+            WriteError(w, code)
+        } else {
+
+            // receive messages.
+            if envelopes, err := receiver.Receive(key(identity.Address), since, timeout, r.Context().Done()); err != nil {
+                WriteError(w, PollReceiveError)
+            } else {
+
+                // respond.
+                messages := make([]PollMessage, len(envelopes))
+                for i, envelope := range envelopes {
+                    messages[i] = PollMessage { Id: envelope.Id, Message: json.RawMessage(envelope.Message) }
+                }
+                WriteOk(w, PollResponse { Messages: messages })
+            }
+        }
+    }
+}
+
+type StatusResponse struct {
+    Capacity  int64 `json:"capacity"`
+    Remaining int64 `json:"remaining"`
+    Low       bool  `json:"low"`
+    Exhausted bool  `json:"exhausted"`
+}
+
+// reports the remaining address space, for operators to alert
+// on as the space nears exhaustion.
+func (server *Server) Status(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if remaining, err := services.Allocator.Remaining(); err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        WriteOk(w, StatusResponse {
+            Capacity  : dhcp.Capacity,
+            Remaining : remaining,
+            Low       : remaining < dhcp.LowCapacity,
+            Exhausted : remaining == 0,
+        })
+    }
+}
+
+type ClaimResponse struct {
+    Address  string `json:"address"`
+    Secret   string `json:"secret"`
+}
+
+// registers a claim on the reserved address given as ?address=...,
+// replacing any existing claim. The response holds the secret, 
+// which clients pass as ?claim=... on connect.
+func (server *Server) Claim(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if r.Method != "POST" {
+        w.WriteHeader(405)
+    } else if services.Claims == nil {
+        WriteError(w, AdminClaimError)
+    } else if address, secret, err := services.Claims.Register(r.URL.Query().Get("address")); err == dhcp.ErrNotReserved || err == dhcp.ErrInvalidAddress || err == dhcp.ErrChecksumMismatch {
+        WriteError(w, AdminClaimError)
+    } else if err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        WriteOk(w, ClaimResponse {
+            Address : address,
+            Secret  : secret,
+        })
+    }
+}
+
+type RotateResponse struct {
+    Key      int64  `json:"key"`
+}
+
+// rotates the identity key, sealing new identities with a new key,
+// and retiring keys superseded for longer than the retire period.
+// Rotations are posted by operators, or scheduled by appengine cron,
+// which sends a GET with the X-Appengine-Cron header. Appengine 
+// strips the header from requests made outside of cron.
+func (server *Server) Rotate(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if r.Method != "POST" && r.Header.Get("X-Appengine-Cron") != "true" {
+        w.WriteHeader(405)
+    } else if rotator, ok := services.Encryption.(encryption.Rotator); !ok {
+        WriteError(w, AdminRotateError)
+    } else if key, err := rotator.Rotate(); err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        WriteOk(w, RotateResponse {
+            Key : key,
+        })
+    }
+}
+
+type RevokeResponse struct {
+    Address  string `json:"address"`
+}
+
+// revokes the identities issued for the address given as 
+// ?address=..., disconnecting its client and releasing its lease.
+// Signed forwards from the address fail once its lease is released.
+func (server *Server) Revoke(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if r.Method != "POST" {
+        w.WriteHeader(405)
+    } else if services.Revocations == nil {
+        WriteError(w, AdminRevokeError)
+    } else if address, _, err := normalize(services, r.URL.Query().Get("address")); err != nil {
+        WriteError(w, AdminRevokeError)
+    } else if err := disconnect(services, address); err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        WriteOk(w, RevokeResponse {
+            Address : address,
+        })
+    }
+}
+
+type RefreshResponse struct {
+    Identity  string `json:"identity"`
+    ExpiresAt int64  `json:"expiresAt"`
+    Binding     string `json:"binding,omitempty"`
+    ReplayKey string `json:"replayKey,omitempty"`
+}
+
+// swaps the unexpired identity given as ?identity=... for a new 
+// identity for the same address, renewing the address lease. The
+// new identity keeps the binding, but identities issued before 
+// bindings were introduced are bound again.
+func (server *Server) Refresh(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if identity, code := verify(services, r, "refresh"); code != 0 {
+        WriteError(w, code)
+    } else {
+        bound, secret := identity.Binding, ""
+        if identity.RemoteAddr != "" {
+            var err error
+            if bound, secret, err = binding(services).Bind(r); err != nil {
+                WriteError(w, InternalServerError)
+                return
+            }
+        }
+        if token, expires, code := issue(services, identity.Address, bound); code != 0 {
+            WriteError(w, code)
+        } else if replay_key, code := replayKey(services, token); code != 0 {
+            WriteError(w, code)
+        } else {
+            WriteOk(w, RefreshResponse {
+                Identity  : token,
+                ExpiresAt : expires,
+                Binding   : secret,
+                ReplayKey : replay_key,
+            })
+        }
+    }
+}
+
+type DisconnectResponse struct {
+    Ok        bool   `json:"ok"`
+}
+
+// disconnects the client of the identity given as ?identity=..., 
+// revoking its identities, closing its transport and releasing 
+// its address lease.
+func (server *Server) Disconnect(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if identity, code := verify(services, r, "disconnect"); code != 0 {
+        WriteError(w, code)
+    } else if err := disconnect(services, identity.Address); err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        WriteOk(w, DisconnectResponse { Ok: true })
+    }
+}
+
+// publishes the keys verifying identities as a json web key set, 
+// for services verifying identities offline. The key set is written
+// as is, rather than as api data, so it can be read by json web 
+// token libraries.
+func (server *Server) Keys(w http.ResponseWriter, r *http.Request) {
+    services := server.services(r)
+    if publisher, ok := services.Encryption.(encryption.Publisher); !ok {
+        WriteError(w, KeysPublishError)
+    } else if set, err := publisher.PublicKeys(); err != nil {
+        WriteError(w, InternalServerError)
+    } else if json, err := json.MarshalIndent(set, "", " "); err != nil {
+        WriteError(w, InternalServerError)
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.WriteHeader(200)
+        w.Write(json)
+    }
+}
@@ -0,0 +1,448 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "time"
+    "testing"
+    "errors"
+    "net/url"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "strconv"
+    "encoding/json"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "dhcp"
+    "repository"
+    "encryption"
+    "transport"
+)
+
+// a transport failing to open, for connects failing after the 
+// address is allocated.
+type brokenTransport struct {}
+func (broken brokenTransport) Name() string { return "broken" }
+func (broken brokenTransport) Open(address string) (string, error) { return "", errors.New("broken.") }
+func (broken brokenTransport) Send(address string, message string) error { return transport.ErrNotConnected }
+func (broken brokenTransport) Close(address string) error { return nil }
+
+// a hub over a memory repository, with its repository and space.
+type testHub struct {
+    server *Server
+    store  *repository.MemoryRepository
+    space  dhcp.AddressSpace
+    poll   *transport.PollTransport
+    legacy *encryption.Aes256EncryptionProvider
+    until  *time.Time
+}
+
+func newTestHub(t *testing.T) testHub {
+    store := repository.NewMemoryRepository()
+    space := dhcp.AddressSpace {
+        Permutation : dhcp.NewFeistelPermutation(store),
+        Formatter   : dhcp.DottedFormatter {},
+        Reserved    : dhcp.DefaultReserved,
+    }
+    allocator := dhcp.NewLeaseAddressAllocator(store, space, dhcp.NewVirtualAddressAllocator(store, space), dhcp.DefaultLeasePolicy)
+    legacy    := encryption.NewAesEncryptionProvider(store)
+    provider  := encryption.NewAeadEncryptionProvider(store, encryption.NewKeyRing(encryption.DefaultKeyRefresh, time.Hour), legacy, time.Now().Add(time.Hour))
+    until     := new(time.Time)
+    poll      := transport.NewPollTransport(transport.NewMailbox(16, time.Minute))
+    selector  := transport.NewSelector(poll, brokenTransport {})
+    hub       := NewServer(func(r *http.Request) Services {
+        return Services {
+            Formatter   : space.Formatter,
+            Allocator   : allocator,
+            Claims      : dhcp.NewClaimRegistry(store, space),
+            Encryption  : provider,
+            Transport   : selector,
+            Binding     : IPBinding {},
+            Replay      : NewReplayCache(store),
+            Revocations : NewRevocationList(store),
+            LegacyUntil : *until,
+        }
+    })
+    return testHub { server: hub, store: store, space: space, poll: poll, legacy: legacy, until: until }
+}
+
+// calls the given handler, returns the data of the response, or 
+// the error code.
+func call(handler http.HandlerFunc, r *http.Request, data interface {}) int16 {
+    w := httptest.NewRecorder()
+    handler(w, r)
+    var output struct {
+        Data  json.RawMessage `json:"data"`
+        Error *Error          `json:"error"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &output); err != nil {
+        return InternalServerError
+    } else if output.Error != nil {
+        return output.Error.Code
+    } else if data != nil {
+        if err := json.Unmarshal(output.Data, data); err != nil {
+            return InternalServerError
+        }
+    }
+    return 0
+}
+
+// connects to the given hub with the given query.
+func connect(hub testHub, query url.Values) (ConnectResponse, int16) {
+    var response ConnectResponse
+    code := call(hub.server.Connect, httptest.NewRequest("GET", "/connect?" + query.Encode(), nil), &response)
+    return response, code
+}
+
+func TestConnectKeyRejectedBeforeClaim(t *testing.T) {
+    hub := newTestHub(t)
+    address, secret, err := dhcp.NewClaimRegistry(hub.store, hub.space).Register(dhcp.AddressOf(dhcp.Capacity - 1).String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := url.Values { "address": { address }, "claim": { secret }, "key": { "not a key" } }
+    if _, code := connect(hub, query); code != ConnectKeyError {
+        t.Fatalf("expected %d, got %d", ConnectKeyError, code)
+    }
+    public, _, _ := ed25519.GenerateKey(rand.Reader)
+    query.Set("key", base64.URLEncoding.EncodeToString(public))
+    if response, code := connect(hub, query); code != 0 || response.Address != address {
+        t.Fatalf("expected %s connected, got %v %d", address, response, code)
+    }
+}
+
+func TestConnectReleasesOnFailure(t *testing.T) {
+    hub := newTestHub(t)
+    address, secret, err := dhcp.NewClaimRegistry(hub.store, hub.space).Register(dhcp.AddressOf(dhcp.Capacity - 1).String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := url.Values { "address": { address }, "claim": { secret }, "transport": { "broken" } }
+    if _, code := connect(hub, query); code != ConnectChannelInitializeError {
+        t.Fatalf("expected %d, got %d", ConnectChannelInitializeError, code)
+    }
+    query.Del("transport")
+    if response, code := connect(hub, query); code != 0 || response.Address != address {
+        t.Fatalf("expected %s connected, got %v %d", address, response, code)
+    }
+}
+
+func TestRefreshLegacyIdentity(t *testing.T) {
+    hub := newTestHub(t)
+    // identities of earlier versions hold the remote address, and no times.
+    token, err := hub.legacy.Encrypt(`{"remoteAddr":"192.0.2.1:1234","address":"1.2.3.4.5.6"}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the address was allocated in order, before leases were written.
+    if address, err := dhcp.Parse("1.2.3.4.5.6"); err != nil {
+        t.Fatal(err)
+    } else if err := hub.store.SetDhcpOrdinal(address.Value() + 1); err != nil {
+        t.Fatal(err)
+    }
+    refresh := func() (RefreshResponse, int16) {
+        var response RefreshResponse
+        code := call(hub.server.Refresh, httptest.NewRequest("GET", "/refresh?" + url.Values { "identity": { token } }.Encode(), nil), &response)
+        return response, code
+    }
+    *hub.until = time.Now().Add(-time.Second)
+    if _, code := refresh(); code != ForwardIdentityExpiredError {
+        t.Fatalf("expected %d after the cutoff, got %d", ForwardIdentityExpiredError, code)
+    }
+    *hub.until = time.Now().Add(time.Hour)
+    if response, code := refresh(); code != 0 || response.Identity == "" {
+        t.Fatalf("expected legacy identity refreshed, got %v %d", response, code)
+    }
+}
+
+// forwards the given request, signed with the given key if any.
+func forward(hub testHub, request ForwardRequest, private ed25519.PrivateKey) int16 {
+    content, _ := json.Marshal(request)
+    r := httptest.NewRequest("POST", "/forward", strings.NewReader(string(content)))
+    if private != nil {
+        r.Header.Set(SignatureHeader, base64.URLEncoding.EncodeToString(ed25519.Sign(private, content)))
+    }
+    return call(hub.server.Forward, r, nil)
+}
+
+// returns the given identity forward with a nonce and timestamp,
+// and its mac keyed with the given replay key.
+func withMac(request ForwardRequest, key string, nonce string) ForwardRequest {
+    secret, _ := base64.URLEncoding.DecodeString(key)
+    request.Nonce, request.Timestamp = nonce, time.Now().Unix()
+    mac := hmac.New(sha256.New, secret)
+    for _, field := range []string { request.Nonce, strconv.FormatInt(request.Timestamp, 10), request.From, request.To, request.Data } {
+        mac.Write([]byte(field + "\n"))
+    }
+    request.Mac = base64.URLEncoding.EncodeToString(mac.Sum(nil))
+    return request
+}
+
+func TestForwardKeyBound(t *testing.T) {
+    hub := newTestHub(t)
+    public, private, _ := ed25519.GenerateKey(rand.Reader)
+    response, code := connect(hub, url.Values { "key": { base64.URLEncoding.EncodeToString(public) } })
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    // once a key is bound, the identity alone can not send.
+    if code := forward(hub, ForwardRequest { Identity: response.Identity, To: response.Address, Data: "a" }, nil); code != ForwardSignatureError {
+        t.Fatalf("expected unsigned forward rejected with %d, got %d", ForwardSignatureError, code)
+    }
+    // forwards failing verification leave the lease as it was.
+    seen := time.Now().Add(-12 * time.Hour)
+    lease, err := hub.store.GetLease(response.Address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lease.LastSeen = seen
+    hub.store.PutLease(lease)
+    _, other, _ := ed25519.GenerateKey(rand.Reader)
+    request := ForwardRequest { From: response.Address, To: response.Address, Data: "b", Timestamp: time.Now().Unix(), Nonce: "1" }
+    if code := forward(hub, request, other); code != ForwardSignatureError {
+        t.Fatalf("expected forward signed by another key rejected, got %d", code)
+    }
+    if lease, err := hub.store.GetLease(response.Address); err != nil || !lease.LastSeen.Equal(seen) {
+        t.Fatalf("expected lease not renewed, got %v %v", lease.LastSeen, err)
+    }
+    if code := forward(hub, request, private); code != 0 {
+        t.Fatalf("expected signed forward accepted, got %d", code)
+    }
+    if lease, err := hub.store.GetLease(response.Address); err != nil || !lease.LastSeen.After(seen) {
+        t.Fatalf("expected lease renewed, got %v %v", lease.LastSeen, err)
+    }
+}
+
+func TestForwardUnsigned(t *testing.T) {
+    hub := newTestHub(t)
+    response, code := connect(hub, url.Values {})
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    for i := 0; i < 2; i++ {
+        if code := forward(hub, withMac(ForwardRequest { Identity: response.Identity, To: response.Address, Data: strconv.Itoa(i) }, response.ReplayKey, strconv.Itoa(i)), nil); code != 0 {
+            t.Fatalf("expected forward accepted, got %d", code)
+        }
+    }
+}
+
+func TestForwardReplayKey(t *testing.T) {
+    hub := newTestHub(t)
+    response, code := connect(hub, url.Values {})
+    if code != 0 || response.ReplayKey == "" {
+        t.Fatalf("expected connected with a replay key, got %v %d", response, code)
+    }
+    request := ForwardRequest { Identity: response.Identity, To: response.Address, Data: "a" }
+    if code := forward(hub, request, nil); code != ForwardSignatureError {
+        t.Fatalf("expected forward without nonce rejected with %d, got %d", ForwardSignatureError, code)
+    }
+    signed := withMac(request, response.ReplayKey, "1")
+    if code := forward(hub, signed, nil); code != 0 {
+        t.Fatalf("expected forward accepted, got %d", code)
+    }
+    if code := forward(hub, signed, nil); code != ForwardReplayError {
+        t.Fatalf("expected replay rejected with %d, got %d", ForwardReplayError, code)
+    }
+    // a captured forward replayed with another nonce, or none, fails its mac.
+    for _, nonce := range []string { "2", "" } {
+        replayed := signed
+        replayed.Nonce = nonce
+        if code := forward(hub, replayed, nil); code != ForwardSignatureError {
+            t.Fatalf("expected replay with nonce %q rejected with %d, got %d", nonce, ForwardSignatureError, code)
+        }
+    }
+    // the replay key of another identity does not verify.
+    other, _ := connect(hub, url.Values {})
+    if code := forward(hub, withMac(request, other.ReplayKey, "3"), nil); code != ForwardSignatureError {
+        t.Fatalf("expected forward with another replay key rejected, got %d", code)
+    }
+}
+
+func TestIssueClaims(t *testing.T) {
+    store := repository.NewMemoryRepository()
+    provider, err := encryption.NewSignedTokenProvider(store, encryption.NewKeyRing(encryption.DefaultKeyRefresh, time.Hour), encryption.EdDSA)
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, _, code := issue(Services { Encryption: provider }, "1.2.3.4.5.6", "")
+    if code != 0 {
+        t.Fatalf("expected identity issued, got %d", code)
+    }
+    var claims struct {
+        Sub string `json:"sub"`
+        Iat int64  `json:"iat"`
+        Exp int64  `json:"exp"`
+    }
+    parts := strings.Split(token, ".")
+    if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+        t.Fatal(err)
+    } else if err := json.Unmarshal(payload, &claims); err != nil {
+        t.Fatal(err)
+    }
+    if claims.Sub != "1.2.3.4.5.6" || claims.Iat == 0 || claims.Exp != claims.Iat + int64(IdentityLifetime / time.Second) {
+        t.Fatalf("expected registered claims, got %+v", claims)
+    }
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+    hub := newTestHub(t)
+    address, secret, err := dhcp.NewClaimRegistry(hub.store, hub.space).Register(dhcp.AddressOf(dhcp.Capacity - 1).String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := url.Values { "address": { address }, "claim": { secret } }
+    first, code := connect(hub, query)
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    if code := call(hub.server.Disconnect, httptest.NewRequest("GET", "/disconnect?" + url.Values { "identity": { first.Identity } }.Encode(), nil), nil); code != 0 {
+        t.Fatalf("expected disconnected, got %d", code)
+    }
+    // identities issued after the revocation, even in the same second, are valid.
+    second, code := connect(hub, query)
+    if code != 0 {
+        t.Fatalf("expected reconnected, got %d", code)
+    }
+    if code := forward(hub, ForwardRequest { Identity: first.Identity, To: address, Data: "a" }, nil); code != ForwardIdentityRevokedError {
+        t.Fatalf("expected revoked identity rejected with %d, got %d", ForwardIdentityRevokedError, code)
+    }
+    if code := forward(hub, withMac(ForwardRequest { Identity: second.Identity, To: address, Data: "b" }, second.ReplayKey, "1"), nil); code != 0 {
+        t.Fatalf("expected new identity accepted, got %d", code)
+    }
+}
+
+// requests the given endpoint for the given identity, signed with 
+// the given key if any.
+func request(hub testHub, handler http.HandlerFunc, name string, query string, private ed25519.PrivateKey) int16 {
+    r := httptest.NewRequest("GET", "/" + name + "?" + query, nil)
+    if private != nil {
+        r.Header.Set(SignatureHeader, base64.URLEncoding.EncodeToString(ed25519.Sign(private, []byte(name + "?" + query))))
+    }
+    return call(handler, r, nil)
+}
+
+func TestSignedIdentityRequests(t *testing.T) {
+    hub := newTestHub(t)
+    public, private, _ := ed25519.GenerateKey(rand.Reader)
+    response, code := connect(hub, url.Values { "key": { base64.URLEncoding.EncodeToString(public) } })
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    identity := url.Values { "identity": { response.Identity } }.Encode()
+    signed   := identity + "&timestamp=" + strconv.FormatInt(time.Now().Unix(), 10) + "&nonce=1"
+    // a leaked identity alone can not poll, refresh or disconnect the address.
+    endpoints := map[string]http.HandlerFunc { 
+        "poll"       : hub.server.Poll, 
+        "refresh"    : hub.server.Refresh, 
+        "disconnect" : hub.server.Disconnect,
+    }
+    for name, handler := range endpoints {
+        if code := request(hub, handler, name, identity + "&timeout=0", nil); code != ForwardSignatureError {
+            t.Fatalf("expected unsigned %s rejected with %d, got %d", name, ForwardSignatureError, code)
+        }
+        if code := request(hub, handler, name, signed, nil); code != ForwardSignatureError {
+            t.Fatalf("expected %s without signature rejected with %d, got %d", name, ForwardSignatureError, code)
+        }
+    }
+    stale := identity + "&timestamp=" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + "&nonce=2"
+    if code := request(hub, hub.server.Refresh, "refresh", stale, private); code != ForwardTimestampError {
+        t.Fatalf("expected stale refresh rejected with %d, got %d", ForwardTimestampError, code)
+    }
+    _, other, _ := ed25519.GenerateKey(rand.Reader)
+    if code := request(hub, hub.server.Poll, "poll", signed + "&timeout=0", other); code != ForwardSignatureError {
+        t.Fatalf("expected poll signed by another key rejected, got %d", code)
+    }
+    if code := request(hub, hub.server.Poll, "poll", signed + "&timeout=0", private); code != 0 {
+        t.Fatalf("expected signed poll accepted, got %d", code)
+    }
+    if code := request(hub, hub.server.Poll, "poll", signed + "&timeout=0", private); code != ForwardReplayError {
+        t.Fatalf("expected replayed poll rejected with %d, got %d", ForwardReplayError, code)
+    }
+    // nonces are shared by all endpoints of the address.
+    if code := request(hub, hub.server.Disconnect, "disconnect", signed, private); code != ForwardReplayError {
+        t.Fatalf("expected disconnect with a used nonce rejected with %d, got %d", ForwardReplayError, code)
+    }
+    if code := request(hub, hub.server.Disconnect, "disconnect", strings.Replace(signed, "nonce=1", "nonce=3", 1), private); code != 0 {
+        t.Fatalf("expected signed disconnect accepted, got %d", code)
+    }
+}
+
+func TestDisconnectRevocation(t *testing.T) {
+    hub := newTestHub(t)
+    *hub.until = time.Now().Add(30 * 24 * time.Hour)
+    public, private, _ := ed25519.GenerateKey(rand.Reader)
+    response, code := connect(hub, url.Values { "key": { base64.URLEncoding.EncodeToString(public) } })
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    identity := url.Values { "identity": { response.Identity } }.Encode()
+    if code := request(hub, hub.server.Disconnect, "disconnect", identity, nil); code != ForwardSignatureError {
+        t.Fatalf("expected unsigned disconnect rejected with %d, got %d", ForwardSignatureError, code)
+    }
+    signed := identity + "&timestamp=" + strconv.FormatInt(time.Now().Unix(), 10) + "&nonce=1"
+    if code := request(hub, hub.server.Disconnect, "disconnect", signed, private); code != 0 {
+        t.Fatalf("expected signed disconnect accepted, got %d", code)
+    }
+    // legacy identities are accepted until the cutoff, so are revoked until then.
+    if revocation, err := hub.store.GetRevocation(response.Address); err != nil || revocation.Expires.Before(*hub.until) {
+        t.Fatalf("expected revocation held until the legacy cutoff, got %v %v", revocation.Expires, err)
+    }
+}
+
+func TestForwardOffline(t *testing.T) {
+    hub := newTestHub(t)
+    sender, code := connect(hub, url.Values {})
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    recipient, code := connect(hub, url.Values {})
+    if code != 0 {
+        t.Fatalf("expected connected, got %d", code)
+    }
+    send := func(to string, nonce string) int16 {
+        return forward(hub, withMac(ForwardRequest { Identity: sender.Identity, To: to, Data: "a" }, sender.ReplayKey, nonce), nil)
+    }
+    if code := send(recipient.Address, "1"); code != 0 {
+        t.Fatalf("expected forward to connected recipient accepted, got %d", code)
+    }
+    // valid recipients with no client connected are reported offline.
+    if code := send("1.2.3.4.5.6", "2"); code != ForwardRecipientOfflineError {
+        t.Fatalf("expected unconnected recipient rejected with %d, got %d", ForwardRecipientOfflineError, code)
+    }
+    if code := call(hub.server.Disconnect, httptest.NewRequest("GET", "/disconnect?" + url.Values { "identity": { recipient.Identity } }.Encode(), nil), nil); code != 0 {
+        t.Fatalf("expected disconnected, got %d", code)
+    }
+    if code := send(recipient.Address, "3"); code != ForwardRecipientOfflineError {
+        t.Fatalf("expected disconnected recipient rejected with %d, got %d", ForwardRecipientOfflineError, code)
+    }
+}
@@ -0,0 +1,156 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package server
+
+import (
+    "time"
+    "bytes"
+    "strconv"
+    "net/http"
+    "crypto/ed25519"
+    "encoding/base64"
+    "dhcp"
+)
+
+// the header clients send the signature of a signed forward in.
+const SignatureHeader = "X-Hub-Signature"
+
+// the most the timestamp of a signed forward may differ from the
+// time it is received.
+const SignatureWindow = 5 * time.Minute
+
+// parses the base64 ed25519 public key given on connect, if any, 
+// before a address is allocated for it. returns the key, nil if 
+// none was given, or a non zero error code if the key is malformed,
+// or the allocator does not bind keys.
+func parseKey(services Services, input string) ([]byte, int16) {
+    if input == "" {
+        return nil, 0
+    }
+    if _, ok := services.Allocator.(dhcp.KeyBinder); !ok {
+        return nil, ConnectKeyError
+    } else if key, err := base64.URLEncoding.DecodeString(input); err != nil || len(key) != ed25519.PublicKeySize {
+        return nil, ConnectKeyError
+    } else {
+        return key, 0
+    }
+}
+
+// binds the given public key, if any, to the lease on the given 
+// address. returns a non zero error code if the key was not bound.
+func bindKey(services Services, address string, key []byte) int16 {
+    if key == nil {
+        return 0
+    }
+    if binder, ok := services.Allocator.(dhcp.KeyBinder); !ok {
+        return ConnectKeyError
+    } else if err := binder.BindKey(address, key); err != nil {
+        return ConnectAddressAllocationError
+    }
+    return 0
+}
+
+// verifies a forward signed with the key bound on connect, renewing
+// the lease only once the signature is verified. The
+// signature is the base64 ed25519 signature of the request body,
+// which must hold the senders address as from, a timestamp in 
+// unix seconds within the signature window, and a nonce. returns
+// the identity of the sender, or a non zero error code.
+func verifySignature(services Services, r *http.Request, request ForwardRequest, content []byte) (Identity, int16) {
+    var identity Identity
+    if binder, ok := services.Allocator.(dhcp.KeyBinder); !ok {
+        return identity, ForwardSignatureError
+    } else if signature, err := base64.URLEncoding.DecodeString(r.Header.Get(SignatureHeader)); err != nil || len(signature) != ed25519.SignatureSize || request.Nonce == "" {
+        return identity, ForwardSignatureError
+    } else if skew := time.Since(time.Unix(request.Timestamp, 0)); skew > SignatureWindow || skew < -SignatureWindow {
+        return identity, ForwardTimestampError
+    } else if address, _, err := normalize(services, request.From); err != nil {
+        return identity, ForwardSenderError
+    } else if key, err := binder.Key(address); err == dhcp.ErrLeaseReleased {
+        return identity, ForwardAddressReleasedError
+    } else if err == dhcp.ErrNoKey {
+        return identity, ForwardSignatureError
+    } else if err != nil {
+        return identity, InternalServerError
+    } else if !ed25519.Verify(ed25519.PublicKey(key), content, signature) {
+        return identity, ForwardSignatureError
+    } else if renewed, err := binder.RenewKey(address); err == dhcp.ErrLeaseReleased {
+        return identity, ForwardAddressReleasedError
+    } else if err != nil || !bytes.Equal(renewed, key) {
+        // the address was leased again since the key was read.
+        return identity, ForwardSignatureError
+    } else {
+        identity.Address = address
+        return identity, 0
+    }
+}
+
+// authorizes a request to the given endpoint for the given identity.
+// Requests for addresses with a bound key must carry a timestamp and
+// nonce in the query, and the signature of the endpoint name and 
+// query, such as poll?identity=...&timestamp=...&nonce=..., so a 
+// leaked identity can not poll, refresh or disconnect the address. 
+// returns a non zero error code if the request is not authorized.
+func authorize(services Services, r *http.Request, endpoint string, identity Identity) int16 {
+    binder, ok := services.Allocator.(dhcp.KeyBinder)
+    if !ok {
+        return 0
+    }
+    query := r.URL.Query()
+    if public_key, err := binder.Key(identity.Address); err == dhcp.ErrNoKey || err == dhcp.ErrLeaseReleased {
+        return 0
+    } else if err != nil {
+        return InternalServerError
+    } else if signature, err := base64.URLEncoding.DecodeString(r.Header.Get(SignatureHeader)); err != nil || len(signature) != ed25519.SignatureSize || query.Get("nonce") == "" {
+        return ForwardSignatureError
+    } else if timestamp, err := strconv.ParseInt(query.Get("timestamp"), 10, 64); err != nil {
+        return ForwardTimestampError
+    } else if skew := time.Since(time.Unix(timestamp, 0)); skew > SignatureWindow || skew < -SignatureWindow {
+        return ForwardTimestampError
+    } else if !ed25519.Verify(ed25519.PublicKey(public_key), []byte(endpoint + "?" + r.URL.RawQuery), signature) {
+        return ForwardSignatureError
+    } else if services.Replay != nil {
+        return services.Replay.CheckNonce(key(identity.Address), query.Get("nonce"), timestamp)
+    }
+    return 0
+}
+
+// rejects unsigned forwards from the given address if a key is
+// bound to it. returns a non zero error code if so.
+func unsigned(services Services, address string) int16 {
+    if binder, ok := services.Allocator.(dhcp.KeyBinder); !ok {
+        return 0
+    } else if _, err := binder.Key(address); err == nil {
+        return ForwardSignatureError
+    } else if err == dhcp.ErrNoKey || err == dhcp.ErrLeaseReleased {
+        return 0
+    } else {
+        return InternalServerError
+    }
+}
@@ -0,0 +1,67 @@
+// +build appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "appengine"
+import "appengine/channel"
+
+// appengine channel api transport.
+type ChannelTransport struct {
+  context appengine.Context
+}
+
+// the name of this transport.
+func (transport ChannelTransport) Name() string {
+  return "channel"
+}
+
+// opens a appengine channel for the given address, returns the channel token.
+func (transport ChannelTransport) Open(address string) (string, error) {
+  return channel.Create(transport.context, address)
+}
+
+// sends the given message to the channel for the given address.
+func (transport ChannelTransport) Send(address string, message string) error {
+  return channel.Send(transport.context, address, message)
+}
+
+// channels can not be closed by the server, the client is left
+// to close its channel, which otherwise expires on its own.
+func (transport ChannelTransport) Close(address string) error {
+  return nil
+}
+
+// creates a new appengine channel transport.
+func NewChannelTransport(context appengine.Context) * ChannelTransport {
+  var transport = new(ChannelTransport)
+  transport.context = context
+  return transport
+}
@@ -0,0 +1,122 @@
+// +build !appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "fmt"
+import "time"
+import "strconv"
+import "net/http"
+
+// interval between keep alive comments on a event stream.
+const EventSourceHeartbeatInterval = 15 * time.Second
+
+// server-sent events transport. Open creates a mailbox for the
+// address and returns its key, which the client uses to read the
+// stream from this transports http handler with ?stream=... The
+// key remains valid for the life of the mailbox, so clients may
+// reconnect and resume from the Last-Event-ID they last received.
+type EventSourceTransport struct {
+  mailbox *Mailbox
+}
+
+// the name of this transport.
+func (transport *EventSourceTransport) Name() string {
+  return "sse"
+}
+
+// opens a mailbox for the given address, returns the stream key.
+func (transport *EventSourceTransport) Open(address string) (string, error) {
+  return transport.mailbox.Open(address)
+}
+
+// sends the given message to the mailbox for the given address.
+func (transport *EventSourceTransport) Send(address string, message string) error {
+  return transport.mailbox.send(address, message)
+}
+
+// closes the mailbox for the given address, ending its stream.
+func (transport *EventSourceTransport) Close(address string) error {
+  transport.mailbox.Close(address)
+  return nil
+}
+
+// streams the mailbox for the given stream key as text/event-stream.
+func (transport *EventSourceTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  address, ok := transport.mailbox.Address(r.URL.Query().Get("stream"))
+  if !ok {
+    http.Error(w, "invalid or expired stream.", 403)
+    return
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming not supported.", 500)
+    return
+  }
+  var since int64 = 0
+  if id, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+    since = id
+  }
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("X-Accel-Buffering", "no")
+  w.WriteHeader(200)
+  fmt.Fprintf(w, "retry: %d\n\n", 3000)
+  flusher.Flush()
+  heartbeat := time.NewTicker(EventSourceHeartbeatInterval)
+  defer heartbeat.Stop()
+  for {
+    envelopes, notify, err := transport.mailbox.Receive(address, since)
+    if err != nil {
+      return
+    }
+    for _, envelope := range envelopes {
+      fmt.Fprintf(w, "id: %d\ndata: %s\n\n", envelope.Id, envelope.Message)
+      since = envelope.Id
+    }
+    flusher.Flush()
+    select {
+      case <-notify:
+      case <-heartbeat.C:
+        if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+          return
+        }
+      case <-r.Context().Done():
+        return
+    }
+  }
+}
+
+// creates a new server-sent events transport on the given mailbox.
+func NewEventSourceTransport(mailbox *Mailbox) * EventSourceTransport {
+  var transport = new(EventSourceTransport)
+  transport.mailbox = mailbox
+  return transport
+}
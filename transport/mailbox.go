@@ -0,0 +1,185 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "errors"
+import "sync"
+import "time"
+import "crypto/rand"
+import "encoding/base64"
+
+// returned when sending to a address without a mailbox.
+var ErrNoMailbox = errors.New("no mailbox open for address.")
+
+// a message held in a mailbox. ids increase by one for each
+// message sent to a address, and are used by clients to
+// resume receiving after a reconnect.
+type Envelope struct {
+  Id      int64
+  Message string
+}
+
+// a single addresses mailbox.
+type box struct {
+  key      string
+  messages []Envelope
+  next     int64
+  notify   chan struct{}
+  touched  time.Time
+}
+
+// in process store of recent messages per address. Used by
+// transports where clients receive messages by reading them
+// back from the hub, rather than having them pushed on a
+// socket. Each mailbox retains its most recent messages up
+// to capacity, and is dropped once it has not been read from
+// within the timeout.
+type Mailbox struct {
+  mutex    sync.Mutex
+  boxes    map[string]*box
+  keys     map[string]string
+  capacity int
+  timeout  time.Duration
+}
+
+// opens a new mailbox for the given address, replacing any
+// existing mailbox. returns a key clients may use to read the
+// mailbox.
+func (mailbox *Mailbox) Open(address string) (string, error) {
+  bytes := make([]byte, 24)
+  if _, err := rand.Read(bytes); err != nil {
+    return "", err
+  } else {
+    mailbox.mutex.Lock()
+    defer mailbox.mutex.Unlock()
+    now := time.Now()
+    for other, existing := range mailbox.boxes {
+      if now.Sub(existing.touched) > mailbox.timeout {
+        mailbox.remove(other)
+      }
+    }
+    mailbox.remove(address)
+    key := base64.URLEncoding.EncodeToString(bytes)
+    mailbox.boxes[address] = &box {
+      key     : key,
+      next    : 1,
+      notify  : make(chan struct{}),
+      touched : now,
+    }
+    mailbox.keys[key] = address
+    return key, nil
+  }
+}
+
+// returns the address for the given mailbox key.
+func (mailbox *Mailbox) Address(key string) (string, bool) {
+  mailbox.mutex.Lock()
+  defer mailbox.mutex.Unlock()
+  address, ok := mailbox.keys[key]
+  return address, ok
+}
+
+// puts a message in the mailbox for the given address, waking
+// any readers waiting on the mailbox. returns ErrNoMailbox if no
+// mailbox is open for the address.
+func (mailbox *Mailbox) Put(address string, message string) error {
+  mailbox.mutex.Lock()
+  defer mailbox.mutex.Unlock()
+  if box, ok := mailbox.boxes[address]; !ok {
+    return ErrNoMailbox
+  } else {
+    box.messages = append(box.messages, Envelope { Id: box.next, Message: message })
+    if len(box.messages) > mailbox.capacity {
+      box.messages = box.messages[len(box.messages) - mailbox.capacity:]
+    }
+    box.next += 1
+    close(box.notify)
+    box.notify = make(chan struct{})
+    return nil
+  }
+}
+
+// sends the given message to the mailbox for the given address,
+// for transports delivering from the mailbox. returns 
+// ErrNotConnected if no mailbox is open for the address.
+func (mailbox *Mailbox) send(address string, message string) error {
+  if err := mailbox.Put(address, message); err == ErrNoMailbox {
+    return ErrNotConnected
+  } else {
+    return err
+  }
+}
+
+// receives messages for the given address with ids after since.
+// also returns a channel that is closed on the next put to, or
+// removal of, the mailbox, which readers may wait on when no
+// messages are returned.
+func (mailbox *Mailbox) Receive(address string, since int64) ([]Envelope, <-chan struct{}, error) {
+  mailbox.mutex.Lock()
+  defer mailbox.mutex.Unlock()
+  if box, ok := mailbox.boxes[address]; !ok {
+    return nil, nil, ErrNoMailbox
+  } else {
+    box.touched = time.Now()
+    var output []Envelope
+    for _, envelope := range box.messages {
+      if envelope.Id > since {
+        output = append(output, envelope)
+      }
+    }
+    return output, box.notify, nil
+  }
+}
+
+// closes the mailbox for the given address.
+func (mailbox *Mailbox) Close(address string) {
+  mailbox.mutex.Lock()
+  defer mailbox.mutex.Unlock()
+  mailbox.remove(address)
+}
+
+// removes a mailbox, caller must hold the lock.
+func (mailbox *Mailbox) remove(address string) {
+  if box, ok := mailbox.boxes[address]; ok {
+    close(box.notify)
+    delete(mailbox.keys, box.key)
+    delete(mailbox.boxes, address)
+  }
+}
+
+// creates a new mailbox retaining up to capacity messages per
+// address, dropping mailboxes not read within the timeout.
+func NewMailbox(capacity int, timeout time.Duration) * Mailbox {
+  var mailbox = new(Mailbox)
+  mailbox.boxes    = make(map[string]*box)
+  mailbox.keys     = make(map[string]string)
+  mailbox.capacity = capacity
+  mailbox.timeout  = timeout
+  return mailbox
+}
@@ -0,0 +1,101 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "time"
+
+// transports clients read messages back from, rather than
+// having them pushed.
+type Receiver interface {
+  // receives messages for the given address with ids after since,
+  // waiting up to timeout, or until cancel, for one to arrive.
+  Receive(address string, since int64, timeout time.Duration, cancel <-chan struct{}) ([]Envelope, error)
+}
+
+// http long-polling transport. Open creates a mailbox for the
+// address, which clients read from by polling the hub with
+// their identity, each poll returning the queued messages or
+// waiting until one arrives.
+type PollTransport struct {
+  mailbox *Mailbox
+}
+
+// the name of this transport.
+func (transport *PollTransport) Name() string {
+  return "poll"
+}
+
+// opens a mailbox for the given address. Clients poll with
+// their identity, so no token is returned.
+func (transport *PollTransport) Open(address string) (string, error) {
+  if _, err := transport.mailbox.Open(address); err != nil {
+    return "", err
+  }
+  return "", nil
+}
+
+// sends the given message to the mailbox for the given address.
+func (transport *PollTransport) Send(address string, message string) error {
+  return transport.mailbox.send(address, message)
+}
+
+// closes the mailbox for the given address, ending any waiting polls.
+func (transport *PollTransport) Close(address string) error {
+  transport.mailbox.Close(address)
+  return nil
+}
+
+// receives messages for the given address with ids after since,
+// waiting up to timeout, or until cancel, for one to arrive.
+func (transport *PollTransport) Receive(address string, since int64, timeout time.Duration, cancel <-chan struct{}) ([]Envelope, error) {
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  for {
+    if envelopes, notify, err := transport.mailbox.Receive(address, since); err != nil {
+      return nil, err
+    } else if len(envelopes) > 0 {
+      return envelopes, nil
+    } else {
+      select {
+        case <-notify:
+        case <-timer.C:
+          return envelopes, nil
+        case <-cancel:
+          return envelopes, nil
+      }
+    }
+  }
+}
+
+// creates a new long-polling transport on the given mailbox.
+func NewPollTransport(mailbox *Mailbox) * PollTransport {
+  var transport = new(PollTransport)
+  transport.mailbox = mailbox
+  return transport
+}
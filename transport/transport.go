@@ -0,0 +1,109 @@
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "errors"
+
+// message delivery mechanism for addresses on the hub. A
+// transport is opened for an address on connect, the returned
+// token is handed to the client, which it uses to attach to
+// the transport and receive forwarded messages.
+type Transport interface {
+  // the name of this transport, reported to clients on connect.
+  Name() string
+  // opens the transport for the given address, returns a client token.
+  Open(address string) (string, error)
+  // sends the given message to the given address.
+  Send(address string, message string) error
+  // closes the transport for the given address, disconnecting its 
+  // client. closing a address not open is not an error.
+  Close(address string) error
+}
+
+// returned when selecting a transport not in a selector.
+var ErrUnknownTransport = errors.New("unknown transport.")
+
+// returned when sending to a address with no client connected.
+var ErrNotConnected = errors.New("address not connected.")
+
+// a set of transports clients select from by name on connect.
+// the first transport is the default. Messages are sent on each
+// transport in turn until one accepts, as a address is open on
+// only the transport its client selected.
+type Selector struct {
+  transports []Transport
+}
+
+// selects the transport with the given name, or the default
+// transport if the name is empty.
+func (selector *Selector) Select(name string) (Transport, error) {
+  if name == "" {
+    return selector.transports[0], nil
+  }
+  for _, transport := range selector.transports {
+    if transport.Name() == name {
+      return transport, nil
+    }
+  }
+  return nil, ErrUnknownTransport
+}
+
+// sends the given message to the given address on the first
+// transport that accepts it. returns ErrNotConnected if the 
+// address is open on none of the transports, otherwise the error
+// of the transport it is open on.
+func (selector *Selector) Send(address string, message string) error {
+  var err = ErrNotConnected
+  for _, transport := range selector.transports {
+    if e := transport.Send(address, message); e == nil {
+      return nil
+    } else if e != ErrNotConnected {
+      err = e
+    }
+  }
+  return err
+}
+
+// closes the given address on every transport.
+func (selector *Selector) Close(address string) error {
+  var err error
+  for _, transport := range selector.transports {
+    if e := transport.Close(address); e != nil {
+      err = e
+    }
+  }
+  return err
+}
+
+// creates a new selector over the given transports.
+func NewSelector(transport Transport, transports ...Transport) * Selector {
+  var selector = new(Selector)
+  selector.transports = append([]Transport { transport }, transports...)
+  return selector
+}
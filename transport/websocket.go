@@ -0,0 +1,229 @@
+// +build !appengine
+
+/*--------------------------------------------------------------------------
+
+ smoke-hub-appengine - messaging relay for webrtc.
+
+ The MIT License (MIT)
+
+ Copyright (c) 2016 Haydn Paterson (sinclair) <haydn.developer@gmail.com>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in
+ all copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ THE SOFTWARE.
+ 
+---------------------------------------------------------------------------*/
+
+package transport
+
+import "errors"
+import "sync"
+import "time"
+import "net/http"
+import "crypto/rand"
+import "encoding/base64"
+import "github.com/gorilla/websocket"
+
+// time a websocket ticket remains valid after connect.
+const WebSocketTicketTimeout = 60 * time.Second
+
+// interval between keep alive pings on a socket.
+const WebSocketPingInterval = 30 * time.Second
+
+// number of messages buffered per socket before messages are dropped.
+const WebSocketSendBuffer = 64
+
+// a one time ticket issued on open, exchanged for a socket.
+type ticket struct {
+  address string
+  expires time.Time
+}
+
+// a connected socket for a address.
+type socket struct {
+  conn   *websocket.Conn
+  send   chan string
+  closed chan struct{}
+  once   sync.Once
+}
+
+// closes this socket, safe to call more than once.
+func (socket *socket) close() {
+  socket.once.Do(func() {
+    close(socket.closed)
+    socket.conn.Close()
+  })
+}
+
+// websocket transport. Open issues a one time ticket which the
+// client exchanges for a socket by connecting to this transports
+// http handler with ?ticket=... Forwarded messages are pushed as
+// text frames on the socket. Sockets are held in process, so all
+// clients must connect to the same hub instance.
+type WebSocketTransport struct {
+  mutex    sync.Mutex
+  tickets  map[string]ticket
+  sockets  map[string]*socket
+  upgrader websocket.Upgrader
+}
+
+// the name of this transport.
+func (transport *WebSocketTransport) Name() string {
+  return "websocket"
+}
+
+// issues a socket ticket for the given address.
+func (transport *WebSocketTransport) Open(address string) (string, error) {
+  bytes := make([]byte, 24)
+  if _, err := rand.Read(bytes); err != nil {
+    return "", err
+  } else {
+    transport.mutex.Lock()
+    defer transport.mutex.Unlock()
+    now := time.Now()
+    for key, ticket := range transport.tickets {
+      if now.After(ticket.expires) {
+        delete(transport.tickets, key)
+      }
+    }
+    key := base64.URLEncoding.EncodeToString(bytes)
+    transport.tickets[key] = ticket { address: address, expires: now.Add(WebSocketTicketTimeout) }
+    return key, nil
+  }
+}
+
+// sends the given message to the socket for the given address.
+// returns ErrNotConnected if no socket is connected, or it closed.
+func (transport *WebSocketTransport) Send(address string, message string) error {
+  transport.mutex.Lock()
+  socket, ok := transport.sockets[address]
+  transport.mutex.Unlock()
+  if !ok {
+    return ErrNotConnected
+  }
+  select {
+    case socket.send <- message:
+      return nil
+    case <-socket.closed:
+      return ErrNotConnected
+    default:
+      return errors.New("socket send buffer full.")
+  }
+}
+
+// closes the socket for the given address, and drops any tickets 
+// issued for it.
+func (transport *WebSocketTransport) Close(address string) error {
+  transport.mutex.Lock()
+  defer transport.mutex.Unlock()
+  for key, ticket := range transport.tickets {
+    if ticket.address == address {
+      delete(transport.tickets, key)
+    }
+  }
+  if socket, ok := transport.sockets[address]; ok {
+    delete(transport.sockets, address)
+    socket.close()
+  }
+  return nil
+}
+
+// exchanges a ticket for a socket. replaces any existing
+// socket for the tickets address.
+func (transport *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  transport.mutex.Lock()
+  key := r.URL.Query().Get("ticket")
+  ticket, ok := transport.tickets[key]
+  delete(transport.tickets, key)
+  transport.mutex.Unlock()
+  if !ok || time.Now().After(ticket.expires) {
+    http.Error(w, "invalid or expired ticket.", 403)
+    return
+  }
+  if conn, err := transport.upgrader.Upgrade(w, r, nil); err != nil {
+    return
+  } else {
+    socket := &socket {
+      conn   : conn,
+      send   : make(chan string, WebSocketSendBuffer),
+      closed : make(chan struct{}),
+    }
+    transport.mutex.Lock()
+    if existing, ok := transport.sockets[ticket.address]; ok {
+      existing.close()
+    }
+    transport.sockets[ticket.address] = socket
+    transport.mutex.Unlock()
+    go transport.write(socket)
+    transport.read(socket)
+    transport.mutex.Lock()
+    if transport.sockets[ticket.address] == socket {
+      delete(transport.sockets, ticket.address)
+    }
+    transport.mutex.Unlock()
+    socket.close()
+  }
+}
+
+// reads from the socket until it closes. clients do not send
+// on the socket, reads are only used to observe pongs and close.
+func (transport *WebSocketTransport) read(socket *socket) {
+  socket.conn.SetReadLimit(512)
+  socket.conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+  socket.conn.SetPongHandler(func(string) error {
+    return socket.conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+  })
+  for {
+    if _, _, err := socket.conn.ReadMessage(); err != nil {
+      return
+    }
+  }
+}
+
+// writes queued messages and keep alive pings to the socket.
+func (transport *WebSocketTransport) write(socket *socket) {
+  ticker := time.NewTicker(WebSocketPingInterval)
+  defer ticker.Stop()
+  defer socket.close()
+  for {
+    select {
+      case message := <-socket.send:
+        socket.conn.SetWriteDeadline(time.Now().Add(WebSocketPingInterval))
+        if err := socket.conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+          return
+        }
+      case <-ticker.C:
+        if err := socket.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WebSocketPingInterval)); err != nil {
+          return
+        }
+      case <-socket.closed:
+        return
+    }
+  }
+}
+
+// creates a new websocket transport.
+func NewWebSocketTransport() * WebSocketTransport {
+  var transport = new(WebSocketTransport)
+  transport.tickets  = make(map[string]ticket)
+  transport.sockets  = make(map[string]*socket)
+  transport.upgrader = websocket.Upgrader {
+    // sockets are authorized by ticket, the hub api is open to all origins.
+    CheckOrigin: func(r *http.Request) bool { return true },
+  }
+  return transport
+}
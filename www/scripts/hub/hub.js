@@ -6,44 +6,220 @@
 
 var hub = hub || {}
 
+// sets the given headers, if any, on the given request.
+hub.headers = function (xhr, headers) {
+  Object.keys(headers || {}).forEach(function (name) {
+    xhr.setRequestHeader(name, headers[name])
+  })
+}
+
 hub.http = {
-  get: function (endpoint, callback) {
+  get: function (endpoint, callback, headers) {
       let xhr = new XMLHttpRequest()
       xhr.open("GET", endpoint)
+      hub.headers(xhr, headers)
       xhr.addEventListener("readystatechange", function() {
         if (xhr.readyState === XMLHttpRequest.DONE) {
           switch (xhr.status) {
             case 200:
+            case 500:
               callback(JSON.parse(xhr.responseText))
               break;
+            default:
+              callback({ error: { code: xhr.status, message: "http error." } })
+              break;
           }
         }
       })
       xhr.send()
   },
-  post: function (endpoint, data, callback) {
+  post: function (endpoint, data, callback, headers) {
       var xhr = new XMLHttpRequest()
       xhr.open("POST", endpoint)
       xhr.setRequestHeader('Content-type', 'application/json')
+      hub.headers(xhr, headers)
       xhr.addEventListener("readystatechange", function () {
         if (xhr.readyState === XMLHttpRequest.DONE) {
           switch (xhr.status) {
             case 200:
+            case 500:
               callback(JSON.parse(xhr.responseText));
               break;
+            default:
+              callback({ error: { code: xhr.status, message: "http error." } })
+              break;
           }
         }
       })
-      xhr.send(JSON.stringify(data))
+      xhr.send(typeof data === "string" ? data : JSON.stringify(data))
+  }
+}
+
+// transports tried in order on connect, falling back to
+// the next when the hub or browser does not support one.
+hub.transports = ["websocket", "sse", "poll", "channel"]
+
+// returns true if the browser supports the given transport.
+hub.supports = function (transport) {
+  switch (transport) {
+    case "websocket": return typeof WebSocket   !== "undefined"
+    case "sse":       return typeof EventSource !== "undefined"
+    case "poll":      return true
+    case "channel":   return typeof goog !== "undefined" && typeof goog.appengine !== "undefined"
+    default:          return false
   }
 }
 
-hub.client = function (endpoint, resolve) {
-    hub.http.get("./connect", function(response) {
+// returns the headers binding requests to the given connection,
+// for hubs binding identities to a secret held by the client.
+hub.binding = function (connection) {
+  return connection.binding ? { "X-Hub-Binding": connection.binding } : {}
+}
+
+// encodes the given bytes as padded base64url.
+hub.base64 = function (buffer) {
+  var bytes  = new Uint8Array(buffer)
+  var binary = ""
+  for (var i = 0; i < bytes.length; i++) {
+    binary += String.fromCharCode(bytes[i])
+  }
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_")
+}
+
+// generates a ed25519 key pair for signing forwards. calls back 
+// with null where the browser does not support ed25519.
+hub.generateKey = function (callback) {
+  if (typeof crypto === "undefined" || !crypto.subtle) {
+    return callback(null)
+  }
+  crypto.subtle.generateKey({ name: "Ed25519" }, false, ["sign", "verify"]).then(function (pair) {
+    return crypto.subtle.exportKey("raw", pair.publicKey).then(function (raw) {
+      callback({ pair: pair, publicKey: hub.base64(raw) })
+    })
+  }).catch(function () {
+    callback(null)
+  })
+}
+
+// signs the given body with the given key, calls back with the
+// base64url signature.
+hub.sign = function (key, body, callback) {
+  var bytes = new TextEncoder().encode(body)
+  crypto.subtle.sign({ name: "Ed25519" }, key.pair.privateKey, bytes).then(function (signature) {
+    callback(hub.base64(signature))
+  })
+}
+
+// gets the given endpoint request for the given connection. where
+// a key is given, a timestamp and nonce are added to the query and 
+// the request signed with the key, as hubs require for addresses
+// with a bound key.
+hub.request = function (endpoint, name, query, connection, key, callback) {
+  var headers = hub.binding(connection)
+  if (!key) {
+    return hub.http.get(endpoint + name + "?" + query, callback, headers)
+  }
+  query += "&timestamp=" + Math.floor(Date.now() / 1000) + "&nonce=" + hub.base64(crypto.getRandomValues(new Uint8Array(16)))
+  hub.sign(key, name + "?" + query, function (signature) {
+    headers["X-Hub-Signature"] = signature
+    hub.http.get(endpoint + name + "?" + query, callback, headers)
+  })
+}
+
+// calls back with the base64url mac of the given forward request,
+// keyed with the given base64url replay key.
+hub.mac = function (replayKey, request, callback) {
+  var raw   = atob(replayKey.replace(/-/g, "+").replace(/_/g, "/"))
+  var bytes = new Uint8Array(raw.length)
+  for (var i = 0; i < raw.length; i++) {
+    bytes[i] = raw.charCodeAt(i)
+  }
+  var content = [request.nonce, request.timestamp, request.from, request.to, request.data].map(function (field) {
+    return field + "\n"
+  }).join("")
+  crypto.subtle.importKey("raw", bytes, { name: "HMAC", hash: "SHA-256" }, false, ["sign"]).then(function (key) {
+    return crypto.subtle.sign("HMAC", key, new TextEncoder().encode(content))
+  }).then(function (mac) {
+    callback(hub.base64(mac))
+  })
+}
+
+// opens the delivery socket described by the given connection.
+// returns a object with the same onmessage, onerror, onclose
+// and onopen callbacks as the appengine channel socket. polls
+// are signed with the given key, if any.
+hub.open = function (endpoint, connection, key) {
+  switch (connection.transport) {
+    case "websocket":
+      var url = new URL(endpoint + "socket?ticket=" + encodeURIComponent(connection.channel), window.location.href)
+      url.protocol = (url.protocol === "https:") ? "wss:" : "ws:"
+      return new WebSocket(url.toString())
+    case "sse":
+      var source = new EventSource(endpoint + "events?stream=" + encodeURIComponent(connection.channel))
+      var socket = {}
+      var opened = false
+      source.onopen    = function ()  { if (!opened && socket.onopen) { opened = true; socket.onopen() } }
+      source.onmessage = function (e) { if (socket.onmessage) socket.onmessage(e) }
+      source.onerror   = function (e) {
+        if (source.readyState === EventSource.CLOSED) {
+          if (socket.onclose) socket.onclose()
+        } else if (socket.onerror) socket.onerror(e)
+      }
+      return socket
+    case "poll":
+      var socket = {}
+      var since  = 0
+      var poll   = function (first) {
+        var query = "identity=" + encodeURIComponent(connection.identity) + "&since=" + since + (first ? "&timeout=0" : "")
+        hub.request(endpoint, "poll", query, connection, key, function (response) {
+          if (response.error) {
+            if (socket.onerror) socket.onerror(new Error(response.error.message))
+            if (socket.onclose) socket.onclose()
+            return
+          }
+          if (first && socket.onopen) socket.onopen()
+          response.data.messages.forEach(function (message) {
+            since = message.id
+            if (socket.onmessage) socket.onmessage({ data: JSON.stringify(message.message) })
+          })
+          poll(false)
+        })
+      }
+      setTimeout(function () { poll(true) }, 0)
+      return socket
+    default:
+      var channel = new goog.appengine.Channel(connection.channel)
+      return channel.open()
+  }
+}
+
+// connects to the hub, trying each of the given transports in
+// turn until one opens. transports defaults to hub.transports.
+// where the browser supports ed25519, a key is generated and 
+// bound on connect, and forwards are signed with it.
+hub.client = function (endpoint, resolve, transports, key) {
+    if (key === undefined) {
+      return hub.generateKey(function (key) {
+        hub.client(endpoint, resolve, transports, key)
+      })
+    }
+    var remaining = (transports || hub.transports).filter(hub.supports)
+    if (remaining.length === 0) {
+      return
+    }
+    var fallback = function () {
+      hub.client(endpoint, resolve, remaining.slice(1), key)
+    }
+    var query = "connect?transport=" + encodeURIComponent(remaining[0]) + (key ? "&key=" + encodeURIComponent(key.publicKey) : "")
+    hub.http.get(endpoint + query, function(response) {
+      if (response.error) {
+        return fallback()
+      }
       var listeners  = {}
+      var opened     = false
+      var closed     = false
       var connection = response.data
-      var channel    = new goog.appengine.Channel(connection.channel)
-      var socket     = channel.open()
+      var socket     = hub.open(endpoint, connection, key)
       // socket on message.
       socket.onmessage = function (message) {
         listeners["message"] = listeners["message"] || []
@@ -53,30 +229,88 @@ hub.client = function (endpoint, resolve) {
       }
       // socket on error.
       socket.onerror = function (e) {
+        if (!opened) return
         listeners["error"] = listeners["error"] || []
         listeners["error"].forEach(function (callback) {
           callback(e)
         })
       }
-      // socket on close.
+      // socket on close, falls back if not yet opened.
       socket.onclose = function () {
+        if (!opened) {
+          if (socket.close) socket.close()
+          return fallback()
+        }
         listeners["close"] = listeners["close"] || []
         listeners["close"].forEach(function (callback) {
           callback()
         })
       }
+      // refreshes the identity a minute before it expires.
+      var refresh = function () {
+        if (!connection.expiresAt) return
+        var delay = Math.max(0, connection.expiresAt * 1000 - Date.now() - 60000)
+        setTimeout(function () {
+          if (closed) return
+          hub.request(endpoint, "refresh", "identity=" + encodeURIComponent(connection.identity), connection, key, function (response) {
+            if (response.error) {
+              listeners["error"] = listeners["error"] || []
+              listeners["error"].forEach(function (callback) {
+                callback(new Error(response.error.message))
+              })
+              return
+            }
+            connection.identity  = response.data.identity
+            connection.expiresAt = response.data.expiresAt
+            connection.binding   = response.data.binding || connection.binding
+            connection.replayKey = response.data.replayKey
+            refresh()
+          })
+        }, delay)
+      }
       // socket on open
       socket.onopen = function () {
+        opened = true
+        refresh()
         resolve({
           address: function() {
             return connection.address
           },
-          send: function (to, data) {
-            hub.http.post("./forward", {
+          // sends data to the given address, from the given 
+          // sub-address of this client, or from its address.
+          send: function (to, data, from) {
+            var request = {
               identity : connection.identity,
+              from     : from || "",
               to       : to,
-              data     : data
-            }, function() {})
+              data     : data,
+              timestamp: Math.floor(Date.now() / 1000),
+              nonce    : hub.base64(crypto.getRandomValues(new Uint8Array(16)))
+            }
+            if (!key && !connection.replayKey) {
+              return hub.http.post(endpoint + "forward", request, function() {}, hub.binding(connection))
+            }
+            if (!key) {
+              return hub.mac(connection.replayKey, request, function (mac) {
+                request.mac = mac
+                hub.http.post(endpoint + "forward", request, function() {}, hub.binding(connection))
+              })
+            }
+            request.from      = from || connection.address
+            var body = JSON.stringify(request)
+            hub.sign(key, body, function (signature) {
+              var headers = hub.binding(connection)
+              headers["X-Hub-Signature"] = signature
+              hub.http.post(endpoint + "forward", body, function() {}, headers)
+            })
+          },
+          // disconnects from the hub, releasing the address.
+          disconnect: function (callback) {
+            closed = true
+            hub.request(endpoint, "disconnect", "identity=" + encodeURIComponent(connection.identity), connection, key, function (response) {
+              if (socket.close) socket.close()
+              if (callback) callback(response)
+            })
           },
           on: function (event, callback) {
             listeners[event] = listeners[event] || []